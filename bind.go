@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-ns/proxy"
+	"proxy-ns/proxy/transport/socks5"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// listenerPollInterval is how often listening sockets inside the
+// namespace are looked up.
+const listenerPollInterval = 2 * time.Second
+
+// tcpListen is the TCP_LISTEN state in /proc/net/tcp.
+const tcpListen = "0A"
+
+// listeningPorts returns TCP ports listened on non-loopback addresses in
+// the network namespace of pid.
+func listeningPorts(pid int) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/net/%s", pid, name))
+		if err != nil {
+			if os.IsNotExist(err) && name == "tcp6" {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		// Skip the header line
+		scanner.Scan()
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != tcpListen {
+				continue
+			}
+			host, port, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
+			}
+			ip, err := hex.DecodeString(host)
+			if err != nil {
+				continue
+			}
+			// Addresses are stored as native endian 32-bit words.
+			for i := 0; i+4 <= len(ip); i += 4 {
+				ip[i], ip[i+1], ip[i+2], ip[i+3] = ip[i+3], ip[i+2], ip[i+1], ip[i]
+			}
+			if net.IP(ip).IsLoopback() {
+				continue
+			}
+			n, err := strconv.ParseUint(port, 16, 16)
+			if err != nil {
+				continue
+			}
+			ports[uint16(n)] = true
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ports, nil
+}
+
+// manageBind keeps a SOCKS5 BIND on the upstream for every TCP port
+// listened inside the network namespace of pid, and injects accepted
+// connections to the listener through s.
+func manageBind(s *stack.Stack, binder proxy.Binder, pid int, tunIP, tunIP6 net.IP) {
+	cancels := make(map[uint16]context.CancelFunc)
+	for {
+		ports, err := listeningPorts(pid)
+		if err != nil {
+			log.Printf("Failed to get listening ports: %s\n", err)
+		} else {
+			for port, cancel := range cancels {
+				if !ports[port] {
+					cancel()
+					delete(cancels, port)
+				}
+			}
+			for port := range ports {
+				if _, ok := cancels[port]; ok {
+					continue
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[port] = cancel
+				go bindLoop(ctx, s, binder, port, tunIP, tunIP6)
+			}
+		}
+		time.Sleep(listenerPollInterval)
+	}
+}
+
+func bindLoop(ctx context.Context, s *stack.Stack, binder proxy.Binder, port uint16, tunIP, tunIP6 net.IP) {
+	// The peer is unknown, so the address of all zeros is requested.
+	addr := socks5.SerializeAddr("", net.IPv4zero, 0)
+	for ctx.Err() == nil {
+		ln, err := binder.Bind(ctx, addr)
+		if err != nil {
+			log.Printf("bind for port %d: %s\n", port, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(listenerPollInterval):
+			}
+			continue
+		}
+		log.Printf("bind for port %d: listening on %s\n", port, ln.Addr())
+		stop := context.AfterFunc(ctx, func() {
+			ln.Close()
+		})
+		conn, err := ln.Accept()
+		stop()
+		ln.Close()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("bind for port %d: %s\n", port, err)
+			}
+			continue
+		}
+		go injectConn(s, conn, port, tunIP, tunIP6)
+	}
+}
+
+// injectConn connects to port inside the namespace from the address of
+// the peer accepted on the proxy server, and forwards conn to it.
+func injectConn(s *stack.Stack, conn net.Conn, port uint16, tunIP, tunIP6 net.IP) {
+	peer, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if peer == nil {
+		log.Printf("bind for port %d: unknown peer address %s\n", port, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	var (
+		localIP, remoteIP net.IP
+		proto             tcpip.NetworkProtocolNumber
+	)
+	if ip4 := peer.IP.To4(); ip4 != nil {
+		localIP, remoteIP, proto = ip4, tunIP.To4(), ipv4.ProtocolNumber
+	} else if tunIP6 != nil {
+		localIP, remoteIP, proto = peer.IP, tunIP6, ipv6.ProtocolNumber
+	} else {
+		log.Printf("bind for port %d: IPv6 peer %s without tun_ip6\n", port, peer)
+		conn.Close()
+		return
+	}
+
+	nsConn, err := gonet.DialTCPWithBind(context.Background(), s,
+		tcpip.FullAddress{
+			Addr: tcpip.AddrFromSlice(localIP),
+			Port: uint16(peer.Port),
+		},
+		tcpip.FullAddress{
+			Addr: tcpip.AddrFromSlice(remoteIP),
+			Port: port,
+		},
+		proto,
+	)
+	if err != nil {
+		log.Printf("bind for port %d: failed to connect from %s: %s\n", port, peer, err)
+		conn.Close()
+		return
+	}
+	log.Printf("bind for port %d: accepted %s\n", port, peer)
+	forwardConn(nsConn, conn, io.Copy)
+}
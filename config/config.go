@@ -9,34 +9,113 @@ import (
 	"time"
 )
 
-var UDPSessionTimeout = time.Minute
+var (
+	UDPSessionTimeout   = time.Minute
+	HandshakeTimeout    = 10 * time.Second
+	UDPAssociateTimeout = 10 * time.Second
+)
+
+// socks5Replies maps names of SOCKS5 failure replies to their codes.
+// RFC 1928 section 6
+var socks5Replies = map[string]uint8{
+	"general-failure":     0x01,
+	"not-allowed":         0x02,
+	"network-unreachable": 0x03,
+	"host-unreachable":    0x04,
+	"connection-refused":  0x05,
+	"ttl-expired":         0x06,
+}
 
 type Data struct {
-	TunName           *string `json:"tun_name,omitempty"`
-	TunIP             *string `json:"tun_ip,omitempty"`
-	TunIP6            *string `json:"tun_ip6,omitempty"`
-	Socks5Address     *string `json:"socks5_address,omitempty"`
-	Username          *string `json:"username,omitempty"`
-	Password          *string `json:"password,omitempty"`
-	FakeDNS           *bool   `json:"fake_dns,omitempty"`
-	FakeNetwork       *string `json:"fake_network,omitempty"`
-	DNSServer         *string `json:"dns_server,omitempty"`
-	UDPSessionTimeout *string `json:"udp_session_timeout,omitempty"`
+	ProxyData
+
+	TunName             *string       `json:"tun_name,omitempty"`
+	TunIP               *string       `json:"tun_ip,omitempty"`
+	TunIP6              *string       `json:"tun_ip6,omitempty"`
+	ProxyChain          []ProxyData   `json:"proxy_chain,omitempty"`
+	Proxies             []ProxyData   `json:"proxies,omitempty"`
+	LoadBalance         *string       `json:"load_balance,omitempty"`
+	HealthCheckInterval *string       `json:"health_check_interval,omitempty"`
+	HealthCheckTimeout  *string       `json:"health_check_timeout,omitempty"`
+	HealthCheckTarget   *string       `json:"health_check_target,omitempty"`
+	Socks5Bind          *bool         `json:"socks5_bind,omitempty"`
+	TCPFastOpen         *bool         `json:"tcp_fast_open,omitempty"`
+	ResolveInterval     *string       `json:"resolve_interval,omitempty"`
+	ConnectTimeout      *string       `json:"connect_timeout,omitempty"`
+	HandshakeTimeout    *string       `json:"handshake_timeout,omitempty"`
+	UDPAssociateTimeout *string       `json:"udp_associate_timeout,omitempty"`
+	RetryAttempts       *int          `json:"retry_attempts,omitempty"`
+	RetryBackoff        *string       `json:"retry_backoff,omitempty"`
+	RetryMaxBackoff     *string       `json:"retry_max_backoff,omitempty"`
+	RetryReplies        *[]string     `json:"retry_replies,omitempty"`
+	FakeDNS             *bool         `json:"fake_dns,omitempty"`
+	FakeNetwork         *string       `json:"fake_network,omitempty"`
+	FakeNetwork6        *string       `json:"fake_network6,omitempty"`
+	FakeDNSTTL          *string       `json:"fake_dns_ttl,omitempty"`
+	FakeDNSMaxEntries   *int          `json:"fake_dns_max_entries,omitempty"`
+	FakeDNSAllocation   *string       `json:"fake_dns_allocation,omitempty"`
+	DNSServer           *string       `json:"dns_server,omitempty"`
+	UDPSessionTimeout   *string       `json:"udp_session_timeout,omitempty"`
+	UDPOverTCP          *string       `json:"udp_over_tcp,omitempty"`
+	ResolveTCP          *bool         `json:"resolve_tcp,omitempty"`
+	ResolveUDP          *bool         `json:"resolve_udp,omitempty"`
+	Resolver            *string       `json:"resolver,omitempty"`
+	ResolveCacheTTL     *string       `json:"resolve_cache_ttl,omitempty"`
+	Rules               []RuleData    `json:"rules,omitempty"`
+	RuleSets            []RuleSetData `json:"rule_sets,omitempty"`
+	RuleSetInterval     *string       `json:"rule_set_interval,omitempty"`
+	Remaps              []RemapData   `json:"remaps,omitempty"`
+	HostGateway         *string       `json:"host_gateway,omitempty"`
+	HostGatewayIP       *string       `json:"host_gateway_ip,omitempty"`
+	HostGatewayPorts    *[]string     `json:"host_gateway_ports,omitempty"`
+	PortForwards        *[]string     `json:"port_forwards,omitempty"`
 }
 
 type Config struct {
-	TunName           string
-	TunIP             net.IP
-	TunMask           net.IPMask
-	TunIP6            net.IP
-	TunMask6          net.IPMask
-	Socks5Address     string
-	Username          string
-	Password          string
-	FakeDNS           bool
-	FakeNetwork       *net.IPNet
-	DNSServer         string
-	UDPSessionTimeout time.Duration
+	Proxy
+
+	TunName             string
+	TunIP               net.IP
+	TunMask             net.IPMask
+	TunIP6              net.IP
+	TunMask6            net.IPMask
+	ProxyChain          []Proxy
+	Proxies             []Proxy
+	LoadBalance         string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	HealthCheckTarget   string
+	Socks5Bind          bool
+	TCPFastOpen         bool
+	ResolveInterval     time.Duration
+	ConnectTimeout      time.Duration
+	HandshakeTimeout    time.Duration
+	UDPAssociateTimeout time.Duration
+	RetryAttempts       int
+	RetryBackoff        time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryReplies        []uint8
+	FakeDNS             bool
+	FakeNetwork         *net.IPNet
+	FakeNetwork6        *net.IPNet
+	FakeDNSTTL          time.Duration
+	FakeDNSMaxEntries   int
+	FakeDNSAllocation   string
+	DNSServer           string
+	UDPSessionTimeout   time.Duration
+	UDPOverTCP          string
+	ResolveTCP          bool
+	ResolveUDP          bool
+	Resolver            string
+	ResolveCacheTTL     time.Duration
+	Rules               []Rule
+	RuleSets            []RuleSet
+	RuleSetInterval     time.Duration
+	Remaps              []Remap
+	HostGateway         string
+	HostGatewayIP       net.IP
+	HostGatewayPorts    []PortRange
+	PortForwards        []PortForward
 }
 
 func (cfg *Config) Update(data Data) error {
@@ -67,24 +146,137 @@ func (cfg *Config) Update(data Data) error {
 			cfg.TunMask6 = nil
 		}
 	}
-	if data.Socks5Address != nil {
-		if *data.Socks5Address == "" {
-			return errors.New("Empty socks5 address")
+	if data.ProxyChain != nil {
+		chain := make([]Proxy, 0, len(data.ProxyChain))
+		for i, hopData := range data.ProxyChain {
+			if hopData.Socks5Address == nil {
+				return fmt.Errorf("proxy_chain[%d]: socks5_address not specified", i)
+			}
+			hop := Proxy{
+				ProxyType: "socks5",
+			}
+			// Only the first hop is dialed directly, others may
+			// only be resolvable by the previous hop.
+			if err := hop.Update(hopData, i == 0); err != nil {
+				return fmt.Errorf("proxy_chain[%d]: %w", i, err)
+			}
+			chain = append(chain, hop)
+		}
+		cfg.ProxyChain = chain
+	}
+	if err := cfg.Proxy.Update(data.ProxyData, len(cfg.ProxyChain) == 0); err != nil {
+		return err
+	}
+	if data.Proxies != nil {
+		proxies := make([]Proxy, 0, len(data.Proxies))
+		for i, proxyData := range data.Proxies {
+			if proxyData.Socks5Address == nil {
+				return fmt.Errorf("proxies[%d]: socks5_address not specified", i)
+			}
+			p := Proxy{
+				ProxyType: "socks5",
+			}
+			if err := p.Update(proxyData, len(cfg.ProxyChain) == 0); err != nil {
+				return fmt.Errorf("proxies[%d]: %w", i, err)
+			}
+			proxies = append(proxies, p)
+		}
+		cfg.Proxies = proxies
+	}
+	if data.LoadBalance != nil {
+		switch *data.LoadBalance {
+		case "failover", "round-robin", "least-conn", "latency", "consistent-hash":
+		default:
+			return fmt.Errorf("Invalid load balance policy: %s", *data.LoadBalance)
+		}
+		cfg.LoadBalance = *data.LoadBalance
+	}
+	if data.HealthCheckInterval != nil {
+		duration, err := time.ParseDuration(*data.HealthCheckInterval)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid health check interval: %s", *data.HealthCheckInterval)
+		}
+		cfg.HealthCheckInterval = duration
+	}
+	if data.HealthCheckTimeout != nil {
+		duration, err := time.ParseDuration(*data.HealthCheckTimeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid health check timeout: %s", *data.HealthCheckTimeout)
+		}
+		cfg.HealthCheckTimeout = duration
+	}
+	if data.HealthCheckTarget != nil {
+		if *data.HealthCheckTarget != "" {
+			if _, _, err := net.SplitHostPort(*data.HealthCheckTarget); err != nil {
+				return fmt.Errorf("Invalid health check target: %s: %w", *data.HealthCheckTarget, err)
+			}
+		}
+		cfg.HealthCheckTarget = *data.HealthCheckTarget
+	}
+	if data.Socks5Bind != nil {
+		cfg.Socks5Bind = *data.Socks5Bind
+	}
+	if data.TCPFastOpen != nil {
+		cfg.TCPFastOpen = *data.TCPFastOpen
+	}
+	if data.ResolveInterval != nil {
+		duration, err := time.ParseDuration(*data.ResolveInterval)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid resolve interval: %s", *data.ResolveInterval)
+		}
+		cfg.ResolveInterval = duration
+	}
+	if data.ConnectTimeout != nil {
+		duration, err := time.ParseDuration(*data.ConnectTimeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid connect timeout: %s", *data.ConnectTimeout)
+		}
+		cfg.ConnectTimeout = duration
+	}
+	if data.HandshakeTimeout != nil {
+		duration, err := time.ParseDuration(*data.HandshakeTimeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid handshake timeout: %s", *data.HandshakeTimeout)
+		}
+		cfg.HandshakeTimeout = duration
+	}
+	if data.UDPAssociateTimeout != nil {
+		duration, err := time.ParseDuration(*data.UDPAssociateTimeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid udp associate timeout: %s", *data.UDPAssociateTimeout)
+		}
+		cfg.UDPAssociateTimeout = duration
+	}
+	if data.RetryAttempts != nil {
+		if *data.RetryAttempts < 1 {
+			return fmt.Errorf("Invalid retry attempts: %d", *data.RetryAttempts)
 		}
-		var (
-			addr net.Addr
-			err  error
-		)
-		if addr, err = net.ResolveTCPAddr("tcp", *data.Socks5Address); err != nil {
-			return fmt.Errorf("Invalid socks5 address: %s: %w", *data.Socks5Address, err)
+		cfg.RetryAttempts = *data.RetryAttempts
+	}
+	if data.RetryBackoff != nil {
+		duration, err := time.ParseDuration(*data.RetryBackoff)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("Invalid retry backoff: %s", *data.RetryBackoff)
 		}
-		cfg.Socks5Address = addr.String()
+		cfg.RetryBackoff = duration
 	}
-	if data.Username != nil {
-		cfg.Username = *data.Username
+	if data.RetryMaxBackoff != nil {
+		duration, err := time.ParseDuration(*data.RetryMaxBackoff)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("Invalid retry max backoff: %s", *data.RetryMaxBackoff)
+		}
+		cfg.RetryMaxBackoff = duration
 	}
-	if data.Password != nil {
-		cfg.Password = *data.Password
+	if data.RetryReplies != nil {
+		replies := make([]uint8, 0, len(*data.RetryReplies))
+		for _, name := range *data.RetryReplies {
+			code, ok := socks5Replies[name]
+			if !ok {
+				return fmt.Errorf("Invalid retry reply: %s", name)
+			}
+			replies = append(replies, code)
+		}
+		cfg.RetryReplies = replies
 	}
 	if data.FakeDNS != nil {
 		cfg.FakeDNS = *data.FakeDNS
@@ -96,6 +288,41 @@ func (cfg *Config) Update(data Data) error {
 		}
 		cfg.FakeNetwork = ipNet
 	}
+	if data.FakeNetwork6 != nil {
+		if *data.FakeNetwork6 != "" {
+			_, ipNet, err := net.ParseCIDR(*data.FakeNetwork6)
+			if err != nil {
+				return fmt.Errorf("Invalid fake network: %s: %w", *data.FakeNetwork6, err)
+			}
+			if ipNet.IP.To4() != nil {
+				return fmt.Errorf("Invalid fake network: %s: not an IPv6 network", *data.FakeNetwork6)
+			}
+			cfg.FakeNetwork6 = ipNet
+		} else {
+			cfg.FakeNetwork6 = nil
+		}
+	}
+	if data.FakeDNSTTL != nil {
+		duration, err := time.ParseDuration(*data.FakeDNSTTL)
+		if err != nil || duration < time.Second {
+			return fmt.Errorf("Invalid fake dns ttl: %s", *data.FakeDNSTTL)
+		}
+		cfg.FakeDNSTTL = duration
+	}
+	if data.FakeDNSMaxEntries != nil {
+		if *data.FakeDNSMaxEntries <= 0 {
+			return fmt.Errorf("Invalid fake dns max entries: %d", *data.FakeDNSMaxEntries)
+		}
+		cfg.FakeDNSMaxEntries = *data.FakeDNSMaxEntries
+	}
+	if data.FakeDNSAllocation != nil {
+		switch *data.FakeDNSAllocation {
+		case "sequential", "hash":
+		default:
+			return fmt.Errorf("Invalid fake dns allocation: %s", *data.FakeDNSAllocation)
+		}
+		cfg.FakeDNSAllocation = *data.FakeDNSAllocation
+	}
 	if data.DNSServer != nil {
 		if ip := net.ParseIP(*data.DNSServer); ip == nil {
 			return fmt.Errorf("Invalid dns server: %s", *data.DNSServer)
@@ -109,9 +336,189 @@ func (cfg *Config) Update(data Data) error {
 		}
 		cfg.UDPSessionTimeout = duration
 	}
+	if data.UDPOverTCP != nil {
+		switch *data.UDPOverTCP {
+		case "off", "dns", "uot":
+		default:
+			return fmt.Errorf("Invalid udp over tcp mode: %s", *data.UDPOverTCP)
+		}
+		cfg.UDPOverTCP = *data.UDPOverTCP
+	}
+	if data.ResolveTCP != nil {
+		cfg.ResolveTCP = *data.ResolveTCP
+	}
+	if data.ResolveUDP != nil {
+		cfg.ResolveUDP = *data.ResolveUDP
+	}
+	if data.Resolver != nil {
+		switch *data.Resolver {
+		case "dns", "socks5":
+		default:
+			return fmt.Errorf("Invalid resolver: %s", *data.Resolver)
+		}
+		cfg.Resolver = *data.Resolver
+	}
+	if data.ResolveCacheTTL != nil {
+		duration, err := time.ParseDuration(*data.ResolveCacheTTL)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("Invalid resolve cache ttl: %s", *data.ResolveCacheTTL)
+		}
+		cfg.ResolveCacheTTL = duration
+	}
+	if data.Rules != nil {
+		rules := make([]Rule, 0, len(data.Rules))
+		for i, ruleData := range data.Rules {
+			var rule Rule
+			if err := rule.Update(ruleData); err != nil {
+				return fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			rules = append(rules, rule)
+		}
+		cfg.Rules = rules
+	}
+	if data.RuleSets != nil {
+		ruleSets := make([]RuleSet, 0, len(data.RuleSets))
+		for i, ruleSetData := range data.RuleSets {
+			var ruleSet RuleSet
+			if err := ruleSet.Update(ruleSetData); err != nil {
+				return fmt.Errorf("rule_sets[%d]: %w", i, err)
+			}
+			if hasRuleSet(ruleSets, ruleSet.Name) {
+				return fmt.Errorf("rule_sets[%d]: duplicate name: %s", i, ruleSet.Name)
+			}
+			ruleSets = append(ruleSets, ruleSet)
+		}
+		cfg.RuleSets = ruleSets
+	}
+	if data.RuleSetInterval != nil {
+		duration, err := time.ParseDuration(*data.RuleSetInterval)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid rule set interval: %s", *data.RuleSetInterval)
+		}
+		cfg.RuleSetInterval = duration
+	}
+	if data.Remaps != nil {
+		remaps := make([]Remap, 0, len(data.Remaps))
+		for i, remapData := range data.Remaps {
+			var remap Remap
+			if err := remap.Update(remapData); err != nil {
+				return fmt.Errorf("remaps[%d]: %w", i, err)
+			}
+			remaps = append(remaps, remap)
+		}
+		cfg.Remaps = remaps
+	}
+	if data.HostGateway != nil {
+		cfg.HostGateway = normalizeDomains([]string{*data.HostGateway})[0]
+	}
+	if data.HostGatewayIP != nil {
+		if *data.HostGatewayIP != "" {
+			ip := net.ParseIP(*data.HostGatewayIP)
+			if ip == nil {
+				return fmt.Errorf("Invalid host gateway ip: %s", *data.HostGatewayIP)
+			}
+			cfg.HostGatewayIP = ip
+		} else {
+			cfg.HostGatewayIP = nil
+		}
+	}
+	if data.HostGatewayPorts != nil {
+		ports := make([]PortRange, 0, len(*data.HostGatewayPorts))
+		for _, s := range *data.HostGatewayPorts {
+			port, err := parsePortRange(s)
+			if err != nil {
+				return fmt.Errorf("Invalid host gateway port: %s", s)
+			}
+			ports = append(ports, port)
+		}
+		cfg.HostGatewayPorts = ports
+	}
+	if data.PortForwards != nil {
+		forwards := make([]PortForward, 0, len(*data.PortForwards))
+		for _, s := range *data.PortForwards {
+			forward, err := parsePortForward(s)
+			if err != nil {
+				return fmt.Errorf("Invalid port forward: %s: %w", s, err)
+			}
+			forwards = append(forwards, forward)
+		}
+		cfg.PortForwards = forwards
+	}
+	if cfg.HostGatewayIP != nil && (cfg.HostGatewayIP.Equal(cfg.TunIP) || cfg.HostGatewayIP.Equal(cfg.TunIP6)) {
+		return fmt.Errorf("Invalid host gateway ip: %s: it's the tun ip", cfg.HostGatewayIP)
+	}
+	if cfg.HostGatewayIP != nil && ((cfg.FakeNetwork != nil && cfg.FakeNetwork.Contains(cfg.HostGatewayIP)) || (cfg.FakeNetwork6 != nil && cfg.FakeNetwork6.Contains(cfg.HostGatewayIP))) {
+		return fmt.Errorf("Invalid host gateway ip: %s: it's in the fake network", cfg.HostGatewayIP)
+	}
+	if cfg.HostGateway != "" && !cfg.FakeDNS {
+		return errors.New("host_gateway requires fake_dns")
+	}
+	if cfg.Socks5Bind && !cfg.hasProxyType("socks5") {
+		return fmt.Errorf("socks5_bind is not supported by proxy type %s", cfg.Proxy.ProxyType)
+	}
+	if (cfg.ResolveTCP || cfg.ResolveUDP) && cfg.Resolver == "socks5" && !cfg.hasProxyType("socks5") {
+		return fmt.Errorf("resolver socks5 is not supported by proxy type %s", cfg.Proxy.ProxyType)
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Upstream != "" && !cfg.hasUpstream(rule.Upstream) {
+			return fmt.Errorf("rules[%d]: upstream not found: %s", i, rule.Upstream)
+		}
+		for _, name := range rule.RuleSet {
+			if !hasRuleSet(cfg.RuleSets, name) {
+				return fmt.Errorf("rules[%d]: rule set not found: %s", i, name)
+			}
+		}
+	}
 	return nil
 }
 
+// Validate checks the configuration once the configuration file and the
+// command line are merged.
+func (cfg *Config) Validate() error {
+	for i, hop := range cfg.ProxyChain {
+		if err := hop.Validate(); err != nil {
+			return fmt.Errorf("proxy_chain[%d]: %w", i, err)
+		}
+	}
+	if err := cfg.Proxy.Validate(); err != nil {
+		return err
+	}
+	for i, p := range cfg.Proxies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("proxies[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// hasProxyType reports whether the proxy server or one of the backup
+// proxy servers is of proxyType.
+func (cfg *Config) hasProxyType(proxyType string) bool {
+	if cfg.Proxy.ProxyType == proxyType {
+		return true
+	}
+	for _, p := range cfg.Proxies {
+		if p.ProxyType == proxyType {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUpstream reports whether name is the name of the proxy server or
+// one of the backup proxy servers.
+func (cfg *Config) hasUpstream(name string) bool {
+	if cfg.Proxy.DisplayName() == name {
+		return true
+	}
+	for _, p := range cfg.Proxies {
+		if p.DisplayName() == name {
+			return true
+		}
+	}
+	return false
+}
+
 func FromFile(path string) (*Config, error) {
 	if _, err := os.Stat(path); err != nil {
 		return nil, fmt.Errorf("Config file not found")
@@ -151,7 +558,28 @@ func FromFile(path string) (*Config, error) {
 	}
 
 	cfg := Config{
-		UDPSessionTimeout: UDPSessionTimeout,
+		Proxy: Proxy{
+			ProxyType: "socks5",
+		},
+		UDPSessionTimeout:   UDPSessionTimeout,
+		UDPOverTCP:          "dns",
+		Resolver:            "dns",
+		ResolveCacheTTL:     5 * time.Minute,
+		LoadBalance:         "failover",
+		HealthCheckInterval: 30 * time.Second,
+		HealthCheckTimeout:  5 * time.Second,
+		ResolveInterval:     5 * time.Minute,
+		ConnectTimeout:      10 * time.Second,
+		HandshakeTimeout:    HandshakeTimeout,
+		UDPAssociateTimeout: UDPAssociateTimeout,
+		RetryAttempts:       1,
+		RetryBackoff:        200 * time.Millisecond,
+		RetryMaxBackoff:     2 * time.Second,
+		RetryReplies:        []uint8{0x01, 0x03, 0x04, 0x06},
+		RuleSetInterval:     time.Minute,
+		FakeDNSTTL:          10 * time.Second,
+		FakeDNSMaxEntries:   65536,
+		FakeDNSAllocation:   "sequential",
 	}
 	err = cfg.Update(data)
 	if err != nil {
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortForward forwards connections to HostPort on the host to Port inside
+// the network namespace.
+type PortForward struct {
+	Network string
+	// HostIP is the address listened on the host, nil listens on all
+	// addresses.
+	HostIP   net.IP
+	HostPort uint16
+	Port     uint16
+}
+
+// HostAddress returns the address listened on the host.
+func (f PortForward) HostAddress() string {
+	host := ""
+	if f.HostIP != nil {
+		host = f.HostIP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(f.HostPort)))
+}
+
+func (f PortForward) String() string {
+	return fmt.Sprintf("%s %s to %d", f.Network, f.HostAddress(), f.Port)
+}
+
+// parsePortForward parses [host_ip:]host_port:port[/network].
+func parsePortForward(s string) (PortForward, error) {
+	f := PortForward{Network: "tcp"}
+	rest, network, ok := strings.Cut(s, "/")
+	if ok {
+		if network != "tcp" && network != "udp" {
+			return PortForward{}, fmt.Errorf("invalid network: %s", network)
+		}
+		f.Network = network
+	}
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return PortForward{}, errors.New("port inside the namespace not specified")
+	}
+	port, err := parsePort(rest[i+1:])
+	if err != nil {
+		return PortForward{}, err
+	}
+	f.Port = port
+	rest = rest[:i]
+	if i := strings.LastIndex(rest, ":"); i >= 0 {
+		host := strings.TrimSuffix(strings.TrimPrefix(rest[:i], "["), "]")
+		f.HostIP = net.ParseIP(host)
+		if f.HostIP == nil {
+			return PortForward{}, fmt.Errorf("invalid host ip: %s", host)
+		}
+		rest = rest[i+1:]
+	}
+	f.HostPort, err = parsePort(rest)
+	if err != nil {
+		return PortForward{}, err
+	}
+	return f, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return uint16(port), nil
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ProxyData struct {
+	Name              *string   `json:"name,omitempty"`
+	ProxyType         *string   `json:"proxy_type,omitempty"`
+	Socks5Address     *string   `json:"socks5_address,omitempty"`
+	Username          *string   `json:"username,omitempty"`
+	Password          *string   `json:"password,omitempty"`
+	Cipher            *string   `json:"cipher,omitempty"`
+	TLS               *bool     `json:"tls,omitempty"`
+	TLSCA             *string   `json:"tls_ca,omitempty"`
+	TLSCert           *string   `json:"tls_cert,omitempty"`
+	TLSKey            *string   `json:"tls_key,omitempty"`
+	TLSServerName     *string   `json:"tls_server_name,omitempty"`
+	TLSPinSHA256      *[]string `json:"tls_pin_sha256,omitempty"`
+	PoolSize          *int      `json:"pool_size,omitempty"`
+	PoolIdleTimeout   *string   `json:"pool_idle_timeout,omitempty"`
+	PoolCheckInterval *string   `json:"pool_check_interval,omitempty"`
+	Pipeline          *bool     `json:"pipeline,omitempty"`
+	EarlyData         *bool     `json:"early_data,omitempty"`
+}
+
+type Proxy struct {
+	Name              string
+	ProxyType         string
+	Socks5Address     string
+	Username          string
+	Password          string
+	Cipher            string
+	TLS               bool
+	TLSCA             string
+	TLSCert           string
+	TLSKey            string
+	TLSServerName     string
+	TLSPinSHA256      [][]byte
+	PoolSize          int
+	PoolIdleTimeout   time.Duration
+	PoolCheckInterval time.Duration
+	Pipeline          bool
+	EarlyData         bool
+}
+
+// UnixPrefix is the prefix of Unix domain socket addresses.
+const UnixPrefix = "unix:"
+
+const (
+	defaultPoolIdleTimeout   = 30 * time.Second
+	defaultPoolCheckInterval = 10 * time.Second
+)
+
+// Update updates the proxy with data. direct reports whether the proxy
+// is connected directly, as Unix domain sockets can't be connected
+// through other proxies. Host names are kept, they are resolved when
+// connecting.
+func (p *Proxy) Update(data ProxyData, direct bool) error {
+	if data.Name != nil {
+		p.Name = *data.Name
+	}
+	if data.ProxyType != nil {
+		switch *data.ProxyType {
+		case "socks5", "socks4", "socks4a", "http", "shadowsocks":
+		default:
+			return fmt.Errorf("Invalid proxy type: %s", *data.ProxyType)
+		}
+		p.ProxyType = *data.ProxyType
+	}
+	if data.Socks5Address != nil {
+		if *data.Socks5Address == "" {
+			return errors.New("Empty socks5 address")
+		}
+		if path, ok := strings.CutPrefix(*data.Socks5Address, UnixPrefix); ok {
+			if !direct {
+				return fmt.Errorf("Invalid socks5 address: %s: unix socket must be connected directly", *data.Socks5Address)
+			}
+			if path == "" {
+				return fmt.Errorf("Invalid socks5 address: %s: empty path", *data.Socks5Address)
+			}
+			path, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("Invalid socks5 address: %s: %w", *data.Socks5Address, err)
+			}
+			p.Socks5Address = UnixPrefix + path
+		} else {
+			_, port, err := net.SplitHostPort(*data.Socks5Address)
+			if err == nil {
+				_, err = strconv.ParseUint(port, 10, 16)
+			}
+			if err != nil {
+				return fmt.Errorf("Invalid socks5 address: %s: %w", *data.Socks5Address, err)
+			}
+			p.Socks5Address = *data.Socks5Address
+		}
+	}
+	if data.Username != nil {
+		p.Username = *data.Username
+	}
+	if data.Password != nil {
+		p.Password = *data.Password
+	}
+	if data.Cipher != nil {
+		switch *data.Cipher {
+		case "chacha20-ietf-poly1305", "aes-256-gcm", "aes-128-gcm":
+		default:
+			return fmt.Errorf("Invalid cipher: %s", *data.Cipher)
+		}
+		p.Cipher = *data.Cipher
+	}
+	if data.TLS != nil {
+		p.TLS = *data.TLS
+	}
+	if data.TLSCA != nil {
+		path, err := absPath(*data.TLSCA)
+		if err != nil {
+			return fmt.Errorf("Invalid tls ca: %s: %w", *data.TLSCA, err)
+		}
+		p.TLSCA = path
+	}
+	if data.TLSCert != nil {
+		path, err := absPath(*data.TLSCert)
+		if err != nil {
+			return fmt.Errorf("Invalid tls cert: %s: %w", *data.TLSCert, err)
+		}
+		p.TLSCert = path
+	}
+	if data.TLSKey != nil {
+		path, err := absPath(*data.TLSKey)
+		if err != nil {
+			return fmt.Errorf("Invalid tls key: %s: %w", *data.TLSKey, err)
+		}
+		p.TLSKey = path
+	}
+	if (p.TLSCert == "") != (p.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be specified together")
+	}
+	if data.TLSServerName != nil {
+		p.TLSServerName = *data.TLSServerName
+	}
+	if data.TLSPinSHA256 != nil {
+		pins := make([][]byte, 0, len(*data.TLSPinSHA256))
+		for _, pin := range *data.TLSPinSHA256 {
+			b, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("Invalid tls pin: %s", pin)
+			}
+			pins = append(pins, b)
+		}
+		p.TLSPinSHA256 = pins
+	}
+	if data.PoolSize != nil {
+		if *data.PoolSize < 0 {
+			return fmt.Errorf("Invalid pool size: %d", *data.PoolSize)
+		}
+		p.PoolSize = *data.PoolSize
+	}
+	if data.PoolIdleTimeout != nil {
+		duration, err := time.ParseDuration(*data.PoolIdleTimeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid pool idle timeout: %s", *data.PoolIdleTimeout)
+		}
+		p.PoolIdleTimeout = duration
+	}
+	if data.PoolCheckInterval != nil {
+		duration, err := time.ParseDuration(*data.PoolCheckInterval)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid pool check interval: %s", *data.PoolCheckInterval)
+		}
+		p.PoolCheckInterval = duration
+	}
+	if data.Pipeline != nil {
+		p.Pipeline = *data.Pipeline
+	}
+	if data.EarlyData != nil {
+		p.EarlyData = *data.EarlyData
+	}
+	if p.PoolSize > 0 && p.ProxyType != "socks5" {
+		return fmt.Errorf("pool_size is not supported by proxy type %s", p.ProxyType)
+	}
+	if (p.Pipeline || p.EarlyData) && p.ProxyType != "socks5" {
+		return fmt.Errorf("pipeline and early_data are not supported by proxy type %s", p.ProxyType)
+	}
+	if p.PoolIdleTimeout == 0 {
+		p.PoolIdleTimeout = defaultPoolIdleTimeout
+	}
+	if p.PoolCheckInterval == 0 {
+		p.PoolCheckInterval = defaultPoolCheckInterval
+	}
+	return nil
+}
+
+// Validate checks settings which may come from separate updates, such as
+// the password from the command line and the cipher from the
+// configuration file.
+func (p *Proxy) Validate() error {
+	if p.ProxyType == "shadowsocks" {
+		if p.Cipher == "" {
+			return errors.New("cipher not specified for shadowsocks")
+		}
+		if p.Password == "" {
+			return errors.New("password not specified for shadowsocks")
+		}
+	}
+	return nil
+}
+
+// DisplayName returns the name of the proxy, or its address if unnamed.
+func (p *Proxy) DisplayName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.Socks5Address
+}
+
+// NetworkAddress returns the network and address to dial the proxy server.
+func (p *Proxy) NetworkAddress() (network, address string) {
+	if path, ok := strings.CutPrefix(p.Socks5Address, UnixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", p.Socks5Address
+}
+
+// absPath makes path absolute, as the daemon doesn't run in the current
+// working directory.
+func absPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return filepath.Abs(path)
+}
@@ -0,0 +1,271 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type RuleData struct {
+	Domain        *[]string `json:"domain,omitempty"`
+	DomainSuffix  *[]string `json:"domain_suffix,omitempty"`
+	DomainKeyword *[]string `json:"domain_keyword,omitempty"`
+	DomainRegex   *[]string `json:"domain_regex,omitempty"`
+	CIDR          *[]string `json:"cidr,omitempty"`
+	RuleSet       *[]string `json:"rule_set,omitempty"`
+	Port          *[]string `json:"port,omitempty"`
+	Network       *string   `json:"network,omitempty"`
+	Action        *string   `json:"action,omitempty"`
+	Upstream      *string   `json:"upstream,omitempty"`
+}
+
+// Rule routes connections whose destination matches any of the domain,
+// CIDR and rule set conditions, and whose port and network match. Empty
+// conditions are ignored.
+type Rule struct {
+	Domain        []string
+	DomainSuffix  []string
+	DomainKeyword []string
+	DomainRegex   []string
+	CIDR          []*net.IPNet
+	RuleSet       []string
+	Port          []PortRange
+	Network       string
+	Action        string
+	Upstream      string
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// Contains reports whether port is in the range.
+func (p PortRange) Contains(port uint16) bool {
+	return port >= p.Min && port <= p.Max
+}
+
+// Update updates the rule with data.
+func (r *Rule) Update(data RuleData) error {
+	if data.Domain != nil {
+		r.Domain = normalizeDomains(*data.Domain)
+	}
+	if data.DomainSuffix != nil {
+		r.DomainSuffix = normalizeDomains(*data.DomainSuffix)
+	}
+	if data.DomainKeyword != nil {
+		r.DomainKeyword = normalizeDomains(*data.DomainKeyword)
+	}
+	if data.DomainRegex != nil {
+		for _, expr := range *data.DomainRegex {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("Invalid domain regex: %s: %w", expr, err)
+			}
+		}
+		r.DomainRegex = *data.DomainRegex
+	}
+	if data.CIDR != nil {
+		cidrs := make([]*net.IPNet, 0, len(*data.CIDR))
+		for _, s := range *data.CIDR {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return fmt.Errorf("Invalid cidr: %s: %w", s, err)
+			}
+			cidrs = append(cidrs, ipNet)
+		}
+		r.CIDR = cidrs
+	}
+	if data.RuleSet != nil {
+		r.RuleSet = *data.RuleSet
+	}
+	if data.Port != nil {
+		ports := make([]PortRange, 0, len(*data.Port))
+		for _, s := range *data.Port {
+			port, err := parsePortRange(s)
+			if err != nil {
+				return fmt.Errorf("Invalid port: %s", s)
+			}
+			ports = append(ports, port)
+		}
+		r.Port = ports
+	}
+	if data.Network != nil {
+		switch *data.Network {
+		case "", "tcp", "udp":
+		default:
+			return fmt.Errorf("Invalid network: %s", *data.Network)
+		}
+		r.Network = *data.Network
+	}
+	if data.Action != nil {
+		switch *data.Action {
+		case "proxy", "direct", "reject":
+		default:
+			return fmt.Errorf("Invalid action: %s", *data.Action)
+		}
+		r.Action = *data.Action
+	}
+	if data.Upstream != nil {
+		r.Upstream = *data.Upstream
+	}
+	if r.Action == "" {
+		return errors.New("action not specified")
+	}
+	if r.Upstream != "" && r.Action != "proxy" {
+		return fmt.Errorf("upstream is not supported by action %s", r.Action)
+	}
+	return nil
+}
+
+type RuleSetData struct {
+	Name *string `json:"name,omitempty"`
+	Type *string `json:"type,omitempty"`
+	Path *string `json:"path,omitempty"`
+}
+
+// RuleSet is a list of CIDRs or domain names loaded from a file.
+type RuleSet struct {
+	Name string
+	Type string
+	Path string
+}
+
+// Update updates the rule set with data.
+func (s *RuleSet) Update(data RuleSetData) error {
+	if data.Name != nil {
+		if *data.Name == "" {
+			return errors.New("Empty rule set name")
+		}
+		s.Name = *data.Name
+	}
+	if data.Type != nil {
+		switch *data.Type {
+		case "cidr", "domain", "hosts":
+		default:
+			return fmt.Errorf("Invalid rule set type: %s", *data.Type)
+		}
+		s.Type = *data.Type
+	}
+	if data.Path != nil {
+		path, err := absPath(*data.Path)
+		if err != nil || path == "" {
+			return fmt.Errorf("Invalid rule set path: %s", *data.Path)
+		}
+		s.Path = path
+	}
+	if s.Name == "" {
+		return errors.New("name not specified")
+	}
+	if s.Type == "" {
+		return errors.New("type not specified")
+	}
+	if s.Path == "" {
+		return errors.New("path not specified")
+	}
+	return nil
+}
+
+type RemapData struct {
+	From *string `json:"from,omitempty"`
+	To   *string `json:"to,omitempty"`
+}
+
+// Remap rewrites destinations matching From to To. Port 0 matches any
+// port in From, and keeps the port in To.
+type Remap struct {
+	FromHost string
+	FromPort uint16
+	ToHost   string
+	ToPort   uint16
+}
+
+// Update updates the remap with data.
+func (r *Remap) Update(data RemapData) error {
+	if data.From != nil {
+		host, port, err := parseRemapAddress(*data.From)
+		if err != nil {
+			return fmt.Errorf("Invalid remap from: %s: %w", *data.From, err)
+		}
+		r.FromHost, r.FromPort = host, port
+	}
+	if data.To != nil {
+		host, port, err := parseRemapAddress(*data.To)
+		if err != nil {
+			return fmt.Errorf("Invalid remap to: %s: %w", *data.To, err)
+		}
+		r.ToHost, r.ToPort = host, port
+	}
+	if r.FromHost == "" {
+		return errors.New("from not specified")
+	}
+	if r.ToHost == "" {
+		return errors.New("to not specified")
+	}
+	return nil
+}
+
+// parseRemapAddress parses a host with an optional port. IP addresses
+// are returned in canonical form, domain names are normalized.
+func parseRemapAddress(s string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port.
+		host, portStr = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), ""
+	}
+	if host == "" {
+		return "", 0, errors.New("empty host")
+	}
+	var port uint64
+	if portStr != "" {
+		port, err = strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return "", 0, fmt.Errorf("invalid port: %s", portStr)
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), uint16(port), nil
+	}
+	return normalizeDomains([]string{host})[0], uint16(port), nil
+}
+
+// hasRuleSet reports whether ruleSets has a rule set named name.
+func hasRuleSet(ruleSets []RuleSet, name string) bool {
+	for _, ruleSet := range ruleSets {
+		if ruleSet.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDomains makes domains comparable with names in DNS requests.
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(domain, ".")))
+	}
+	return normalized
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		last = first
+	}
+	lo, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	hi, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	if lo > hi {
+		return PortRange{}, errors.New("empty port range")
+	}
+	return PortRange{Min: uint16(lo), Max: uint16(hi)}, nil
+}
@@ -1,33 +1,38 @@
 package fakedns
 
 import (
-	"encoding/binary"
+	"context"
+	"log"
 	"net"
+	"net/netip"
+	"strings"
 	"sync"
+	"time"
 
 	"proxy-ns/proxy"
 
 	"github.com/miekg/dns"
 )
 
-const maxTtl = 10
-
-func NewServer(packetConn net.PacketConn, dialer proxy.Dialer, upstreamServer string, fakeNetwork *net.IPNet) *Server {
+// NewServer returns a server answering A questions with addresses from
+// fakeNetwork, and AAAA questions with addresses from fakeNetwork6. AAAA
+// questions get empty responses if fakeNetwork6 is nil. Answers have a
+// TTL of ttl, and at most maxEntries domain names are mapped in each
+// network. If hash is true, addresses are derived from hashes of domain
+// names, so that they are stable across sessions. Forwarded queries are
+// waited for at most upstreamTimeout.
+func NewServer(packetConn net.PacketConn, dialer proxy.Dialer, upstreamServer string, upstreamTimeout time.Duration, fakeNetwork, fakeNetwork6 *net.IPNet, ttl time.Duration, maxEntries int, hash bool) *Server {
 	s := &Server{
-		packetConn:     packetConn,
-		dialer:         dialer,
-		upstreamServer: upstreamServer,
-		fakeNetwork:    fakeNetwork,
-
-		mapping:         make(map[string]uint32),
-		reversedMapping: make(map[uint32]string),
-	}
-	ones, bits := fakeNetwork.Mask.Size()
-	zeros := bits - ones
-	size := uint32((1 << zeros) - 1)
-	s.min = binary.BigEndian.Uint32(fakeNetwork.IP)
-	s.max = s.min - 1 + size
-	s.next = s.min - 1
+		packetConn:      packetConn,
+		dialer:          dialer,
+		upstreamServer:  upstreamServer,
+		upstreamTimeout: upstreamTimeout,
+		ttl:             ttl,
+		pool:            newPool(fakeNetwork, ttl, maxEntries, hash),
+	}
+	if fakeNetwork6 != nil {
+		s.pool6 = newPool(fakeNetwork6, ttl, maxEntries, hash)
+	}
 	return s
 }
 
@@ -36,33 +41,100 @@ type Server struct {
 	dialer         proxy.Dialer
 	packetConn     net.PacketConn
 	upstreamServer string
-	fakeNetwork    *net.IPNet
+	// upstreamTimeout is how long forwarding a query to upstreamServer
+	// is waited for, including the connection.
+	upstreamTimeout time.Duration
+	// tcpFallback reports whether queries from UDP clients are
+	// forwarded over TCP when the upstream doesn't support UDP.
+	tcpFallback bool
+	ttl         time.Duration
+
+	mutex sync.Mutex
+	pool  *pool
+	pool6 *pool
+}
 
-	next uint32
-	min  uint32
-	max  uint32
+// SetTCPFallback sets whether queries from UDP clients are forwarded over
+// TCP when the upstream doesn't support UDP. It must be called before
+// use.
+func (s *Server) SetTCPFallback(fallback bool) {
+	s.tcpFallback = fallback
+}
 
-	mutex           sync.Mutex
-	mapping         map[string]uint32
-	reversedMapping map[uint32]string
+// poolOf returns the pool containing ip, or nil if none does.
+func (s *Server) poolOf(ip net.IP) (*pool, netip.Addr) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, addr
+	}
+	addr = addr.Unmap()
+	if s.pool.prefix.Contains(addr) {
+		return s.pool, addr
+	}
+	if s.pool6 != nil && s.pool6.prefix.Contains(addr) {
+		return s.pool6, addr
+	}
+	return nil, addr
 }
 
 func (s *Server) Contains(ip net.IP) bool {
-	return s.fakeNetwork.Contains(ip)
+	p, _ := s.poolOf(ip)
+	return p != nil
 }
 
-func (s *Server) NameFromIP(ip net.IP) (name string) {
-	ipUint := binary.BigEndian.Uint32(ip)
+// Acquire returns the domain name mapped to ip, and keeps the mapping
+// until Release is called for ip. It returns an empty string if ip is
+// not mapped.
+func (s *Server) Acquire(ip net.IP) (name string) {
+	p, addr := s.poolOf(ip)
+	if p == nil {
+		return ""
+	}
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return s.reversedMapping[ipUint]
+	name, _ = p.acquire(addr, time.Now())
+	return name
 }
 
-func (s *Server) reset() {
-	s.next = s.min - 1
-	s.mapping = make(map[string]uint32)
-	s.reversedMapping = make(map[uint32]string)
+// Release releases the mapping of ip acquired by Acquire.
+func (s *Server) Release(ip net.IP) {
+	p, addr := s.poolOf(ip)
+	if p == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p.release(addr, time.Now())
+}
+
+// answer returns a record of the address allocated to the domain name in
+// question from p, or false if no address is available.
+func (s *Server) answer(p *pool, question dns.Question) (dns.RR, bool) {
+	// Names are case-insensitive, some resolvers randomize the case.
+	domain := strings.ToLower(question.Name)
+	if dns.IsFqdn(domain) {
+		domain = domain[:len(domain)-1]
+	}
+
+	s.mutex.Lock()
+	addr := p.allocate(domain, time.Now())
+	s.mutex.Unlock()
+	if !addr.IsValid() {
+		return nil, false
+	}
+
+	hdr := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(s.ttl / time.Second),
+	}
+	if question.Qtype == dns.TypeAAAA {
+		return &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()}, true
+	}
+	return &dns.A{Hdr: hdr, A: addr.AsSlice()}, true
 }
 
 func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
@@ -81,53 +153,54 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	switch question.Qtype {
-	case dns.TypeA:
-		var (
-			ip   net.IP
-			next uint32
-		)
-		domain := question.Name
-		if dns.IsFqdn(domain) {
-			domain = domain[:len(domain)-1]
-		}
-
-		s.mutex.Lock()
-		next, ok := s.mapping[domain]
-		if !ok {
-			s.next += 1
-			if s.next > s.max {
-				s.reset()
-				s.next += 1
+	case dns.TypeA, dns.TypeAAAA:
+		p := s.pool
+		if question.Qtype == dns.TypeAAAA {
+			// empty response for AAAA questions without a fake
+			// IPv6 network
+			if s.pool6 == nil {
+				break
 			}
-			next = s.next
-			s.mapping[domain] = next
-			s.reversedMapping[next] = domain
+			p = s.pool6
 		}
-		s.mutex.Unlock()
-
-		m.Answer = []dns.RR{
-			&dns.A{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    maxTtl,
-				},
-				A: binary.BigEndian.AppendUint32(ip, next),
-			},
+		rr, ok := s.answer(p, question)
+		if !ok {
+			log.Printf("fake DNS: no address available for %s, all are in use\n", question.Name)
+			m.Rcode = dns.RcodeServerFailure
+			break
 		}
-	case dns.TypeAAAA:
-		// empty response for AAAA questions
-		break
+		m.Answer = []dns.RR{rr}
 	default:
-		conn, err := s.dialer.Dial("udp", s.upstreamServer)
+		// Forward over TCP for TCP clients, as responses may be
+		// too large for UDP.
+		network := "udp"
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			network = "tcp"
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.upstreamTimeout)
+		defer cancel()
+		conn, err := s.dialer.DialContext(ctx, network, s.upstreamServer)
+		if err != nil && network == "udp" && s.tcpFallback {
+			// The upstream doesn't support UDP, DNS over TCP is used
+			// as for other UDP packets to port 53.
+			log.Printf("fake DNS: %s, falling back to TCP\n", err)
+			network = "tcp"
+			conn, err = s.dialer.DialContext(ctx, network, s.upstreamServer)
+		}
 		if err != nil {
+			log.Printf("fake DNS: failed to forward %s: %s\n", question.Name, err)
+			m.Rcode = dns.RcodeServerFailure
 			w.WriteMsg(m)
 			return
 		}
 		defer conn.Close()
+		// ctx doesn't affect the connection once it's established.
+		deadline, _ := ctx.Deadline()
+		conn.SetDeadline(deadline)
 		em, err := ExchangeConn(conn, r)
 		if err != nil {
+			log.Printf("fake DNS: failed to forward %s: %s\n", question.Name, err)
+			m.Rcode = dns.RcodeServerFailure
 			w.WriteMsg(m)
 			return
 		}
@@ -144,6 +217,15 @@ func (s *Server) Run() error {
 	return server.ActivateAndServe()
 }
 
+// RunTCP serves DNS over TCP on listener with the same mappings.
+func (s *Server) RunTCP(listener net.Listener) error {
+	server := dns.Server{
+		Listener: listener,
+		Handler:  s,
+	}
+	return server.ActivateAndServe()
+}
+
 func ExchangeConn(c net.Conn, m *dns.Msg) (r *dns.Msg, err error) {
 	co := new(dns.Conn)
 	co.Conn = c
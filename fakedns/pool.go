@@ -0,0 +1,253 @@
+package fakedns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// entry maps a domain name to an address of a pool.
+type entry struct {
+	domain string
+	addr   netip.Addr
+	// expires is when the TTL of the last answer elapses, counted from
+	// the last use of the entry. Unpinned entries are removed after it.
+	expires time.Time
+	// refs is the number of active flows to the address. Entries with
+	// active flows are pinned: they are not in the LRU list, so they are
+	// never evicted.
+	refs int
+	elem *list.Element
+}
+
+// pool allocates addresses of a fake network to domain names,
+// sequentially or by hashes of domain names. Entries without active flows
+// expire when their TTL elapses. When addresses or entries run out, the
+// least recently used entry without active flows is evicted.
+type pool struct {
+	prefix netip.Prefix
+	first  netip.Addr
+	last   netip.Addr
+	// next is the last address allocated sequentially, it's invalid if
+	// none is.
+	next netip.Addr
+
+	ttl        time.Duration
+	maxEntries int
+	// hash reports whether addresses are derived from hashes of domain
+	// names, size is the number of addresses then.
+	hash bool
+	size uint64
+
+	byDomain map[string]*entry
+	byAddr   map[netip.Addr]*entry
+	// lru holds unpinned entries, the most recently used first.
+	lru list.List
+}
+
+func newPool(network *net.IPNet, ttl time.Duration, maxEntries int, hash bool) *pool {
+	first, _ := netip.AddrFromSlice(network.IP)
+	first = first.Unmap()
+	ones, _ := network.Mask.Size()
+	broadcast := first.AsSlice()
+	for i := range broadcast {
+		broadcast[i] |= ^network.Mask[len(network.Mask)-len(broadcast)+i]
+	}
+	last, _ := netip.AddrFromSlice(broadcast)
+	p := &pool{
+		prefix:     netip.PrefixFrom(first, ones),
+		first:      first,
+		last:       last.Prev(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		hash:       hash,
+		size:       math.MaxUint64,
+		byDomain:   make(map[string]*entry),
+		byAddr:     make(map[netip.Addr]*entry),
+	}
+	if zeros := first.BitLen() - ones; zeros < 64 {
+		p.size = 1<<zeros - 1
+	}
+	return p
+}
+
+// allocate returns the address of domain, allocating one if needed. It
+// returns an invalid address if all addresses are pinned.
+func (p *pool) allocate(domain string, now time.Time) netip.Addr {
+	p.expire(now)
+	if e, ok := p.byDomain[domain]; ok {
+		p.touch(e, now)
+		return e.addr
+	}
+
+	var addr netip.Addr
+	if p.hash {
+		addr = p.hashAddr(domain, now)
+	} else {
+		addr = p.nextAddr(domain, now)
+	}
+	if !addr.IsValid() {
+		return addr
+	}
+
+	e := &entry{
+		domain:  domain,
+		addr:    addr,
+		expires: now.Add(p.ttl),
+	}
+	e.elem = p.lru.PushFront(e)
+	p.byDomain[domain] = e
+	p.byAddr[addr] = e
+	return addr
+}
+
+// nextAddr returns an address for domain allocated sequentially, or
+// reused from the least recently used entry when addresses or entries
+// run out. After the last address, it wraps around to addresses freed by
+// expired entries.
+func (p *pool) nextAddr(domain string, now time.Time) netip.Addr {
+	if len(p.byAddr) < p.maxEntries && uint64(len(p.byAddr)) < p.size {
+		for {
+			if !p.next.IsValid() || p.next == p.last {
+				p.next = p.first
+			} else {
+				p.next = p.next.Next()
+			}
+			if _, ok := p.byAddr[p.next]; !ok {
+				return p.next
+			}
+		}
+	}
+	victim := p.evict(domain, now)
+	if victim == nil {
+		return netip.Addr{}
+	}
+	return victim.addr
+}
+
+// hashProbes is how many addresses are tried for a domain name whose
+// address is taken by another one.
+const hashProbes = 16
+
+// hashAddr returns an address derived from a hash of domain, so that it's
+// the same across sessions unless it collides with another domain name.
+// Collisions are resolved by probing other hashes, then by evicting the
+// probed entry expiring first.
+func (p *pool) hashAddr(domain string, now time.Time) netip.Addr {
+	if len(p.byAddr) >= p.maxEntries && p.evict(domain, now) == nil {
+		return netip.Addr{}
+	}
+	var victim *entry
+	for i := 0; i < hashProbes; i++ {
+		h := fnv.New64a()
+		h.Write([]byte(domain))
+		h.Write([]byte{byte(i)})
+		addr := addOffset(p.first, h.Sum64()%p.size)
+		e, ok := p.byAddr[addr]
+		if !ok {
+			return addr
+		}
+		if e.refs == 0 && (victim == nil || e.expires.Before(victim.expires)) {
+			victim = e
+		}
+	}
+	if victim == nil {
+		return netip.Addr{}
+	}
+	p.replace(victim, domain, now)
+	return victim.addr
+}
+
+// expire removes entries without active flows whose TTL elapsed. Each use
+// extends the TTL, so they are the least recently used ones.
+func (p *pool) expire(now time.Time) {
+	for elem := p.lru.Back(); elem != nil; elem = p.lru.Back() {
+		e := elem.Value.(*entry)
+		if now.Before(e.expires) {
+			return
+		}
+		p.remove(e)
+	}
+}
+
+// evict removes the least recently used entry without active flows, and
+// returns it, or nil if all entries have active flows.
+func (p *pool) evict(domain string, now time.Time) *entry {
+	elem := p.lru.Back()
+	if elem == nil {
+		return nil
+	}
+	victim := elem.Value.(*entry)
+	p.replace(victim, domain, now)
+	return victim
+}
+
+// replace removes victim, whose address is allocated to domain.
+func (p *pool) replace(victim *entry, domain string, now time.Time) {
+	if now.Before(victim.expires) {
+		log.Printf("fake DNS: evicting %s for %s before it expires\n", victim.domain, domain)
+	}
+	p.remove(victim)
+}
+
+// addOffset returns the address offset after addr.
+func addOffset(addr netip.Addr, offset uint64) netip.Addr {
+	b := addr.As16()
+	lo := binary.BigEndian.Uint64(b[8:])
+	binary.BigEndian.PutUint64(b[8:], lo+offset)
+	if lo+offset < lo {
+		binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(b[:8])+1)
+	}
+	if addr.Is4() {
+		return netip.AddrFrom16(b).Unmap()
+	}
+	return netip.AddrFrom16(b)
+}
+
+func (p *pool) touch(e *entry, now time.Time) {
+	e.expires = now.Add(p.ttl)
+	if e.elem != nil {
+		p.lru.MoveToFront(e.elem)
+	}
+}
+
+func (p *pool) remove(e *entry) {
+	p.lru.Remove(e.elem)
+	delete(p.byDomain, e.domain)
+	delete(p.byAddr, e.addr)
+}
+
+// acquire pins the entry of addr and returns its domain name, or returns
+// false if addr is not allocated or its entry expired.
+func (p *pool) acquire(addr netip.Addr, now time.Time) (string, bool) {
+	p.expire(now)
+	e, ok := p.byAddr[addr]
+	if !ok {
+		return "", false
+	}
+	if e.refs == 0 {
+		p.lru.Remove(e.elem)
+		e.elem = nil
+	}
+	e.refs++
+	e.expires = now.Add(p.ttl)
+	return e.domain, true
+}
+
+// release unpins the entry of addr once all flows acquiring it ended.
+func (p *pool) release(addr netip.Addr, now time.Time) {
+	e, ok := p.byAddr[addr]
+	if !ok || e.refs == 0 {
+		return
+	}
+	e.refs--
+	if e.refs == 0 {
+		e.expires = now.Add(p.ttl)
+		e.elem = p.lru.PushFront(e)
+	}
+}
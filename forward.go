@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"proxy-ns/config"
+	"proxy-ns/network"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// listenForward listens for forward in the current network namespace, and
+// returns the file of the listener to be passed to the daemon.
+func listenForward(forward config.PortForward) (*os.File, error) {
+	if forward.Network == "udp" {
+		pc, err := net.ListenPacket("udp", forward.HostAddress())
+		if err != nil {
+			return nil, err
+		}
+		defer pc.Close()
+		return pc.(*net.UDPConn).File()
+	}
+	ln, err := net.Listen("tcp", forward.HostAddress())
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	return ln.(*net.TCPListener).File()
+}
+
+// forwardSource returns the address which connections from peers that
+// cannot be seen inside the namespace, such as loopback and IPv6 peers,
+// come from. It's the host gateway ip if set, or the address following
+// the tun ip.
+func forwardSource(cfg *config.Config) net.IP {
+	if ip4 := cfg.HostGatewayIP.To4(); ip4 != nil {
+		return ip4
+	}
+	ip := slices.Clone(cfg.TunIP.To4())
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+	return ip
+}
+
+// manageForward accepts connections or packets of forward from the
+// listener in f, and injects them through s to the port on tunIP.
+func manageForward(s *stack.Stack, forward config.PortForward, f *os.File, tunIP, source net.IP) error {
+	defer f.Close()
+	if forward.Network == "udp" {
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		go forwardUDP(s, forward, pc, tunIP, source)
+		return nil
+	}
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return err
+	}
+	go forwardTCP(s, forward, ln, tunIP, source)
+	return nil
+}
+
+// forwardAddress returns the address inside the namespace which traffic
+// from peer comes from. The peer address is kept if it can be seen inside
+// the namespace.
+func forwardAddress(peer net.IP, peerPort int, source net.IP) tcpip.FullAddress {
+	if ip4 := peer.To4(); ip4 != nil && !ip4.IsLoopback() {
+		return tcpip.FullAddress{
+			Addr: tcpip.AddrFromSlice(ip4),
+			Port: uint16(peerPort),
+		}
+	}
+	return tcpip.FullAddress{Addr: tcpip.AddrFromSlice(source)}
+}
+
+func forwardTCP(s *stack.Stack, forward config.PortForward, ln net.Listener, tunIP, source net.IP) {
+	log.Printf("forward %s: listening\n", forward)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("forward %s: %s\n", forward, err)
+			return
+		}
+		go func() {
+			peer := conn.RemoteAddr().(*net.TCPAddr)
+			nsConn, err := gonet.DialTCPWithBind(context.Background(), s,
+				forwardAddress(peer.IP, peer.Port, source),
+				tcpip.FullAddress{
+					Addr: tcpip.AddrFromSlice(tunIP.To4()),
+					Port: forward.Port,
+				},
+				ipv4.ProtocolNumber,
+			)
+			if err != nil {
+				log.Printf("forward %s: failed to connect from %s: %s\n", forward, peer, err)
+				conn.Close()
+				return
+			}
+			forwardConn(nsConn, conn, io.Copy)
+		}()
+	}
+}
+
+// forwardUDP relays packets from each peer through its own endpoint, so
+// that replies inside the namespace can be sent back to the peer. Idle
+// endpoints are closed after config.UDPSessionTimeout.
+func forwardUDP(s *stack.Stack, forward config.PortForward, pc net.PacketConn, tunIP, source net.IP) {
+	log.Printf("forward %s: listening\n", forward)
+	var sessions sync.Map // map[string]*gonet.UDPConn
+	buf := make([]byte, network.MaxPacketSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("forward %s: %s\n", forward, err)
+			return
+		}
+		var nsConn *gonet.UDPConn
+		if value, ok := sessions.Load(addr.String()); ok {
+			nsConn = value.(*gonet.UDPConn)
+		} else {
+			peer := addr.(*net.UDPAddr)
+			local := forwardAddress(peer.IP, peer.Port, source)
+			nsConn, err = gonet.DialUDP(s, &local, &tcpip.FullAddress{
+				Addr: tcpip.AddrFromSlice(tunIP.To4()),
+				Port: forward.Port,
+			}, ipv4.ProtocolNumber)
+			if err != nil {
+				log.Printf("forward %s: failed to connect from %s: %s\n", forward, peer, err)
+				continue
+			}
+			sessions.Store(addr.String(), nsConn)
+			go func() {
+				defer func() {
+					sessions.Delete(addr.String())
+					nsConn.Close()
+				}()
+				buf := make([]byte, network.MaxPacketSize)
+				for {
+					nsConn.SetReadDeadline(time.Now().Add(config.UDPSessionTimeout))
+					n, err := nsConn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		nsConn.Write(buf[:n])
+	}
+}
@@ -7,6 +7,7 @@ toolchain go1.24.5
 require (
 	github.com/miekg/dns v1.1.67
 	github.com/vishvananda/netlink v1.3.1
+	golang.org/x/crypto v0.40.0
 	golang.org/x/sys v0.34.0
 	gvisor.dev/gvisor v0.0.0-20250715064034-bd36fb3cc7b7
 )
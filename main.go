@@ -11,6 +11,7 @@ import (
 	"runtime"
 	"slices"
 	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -18,6 +19,8 @@ import (
 	"proxy-ns/config"
 	"proxy-ns/fakedns"
 	"proxy-ns/proxy"
+	"proxy-ns/proxy/transport/socks5"
+	"proxy-ns/route"
 
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
@@ -27,6 +30,8 @@ import (
 
 type Data struct {
 	TunMTU uint32
+	// Pid is the process running in the new network namespace.
+	Pid    int
 	Config *config.Config
 }
 
@@ -37,21 +42,39 @@ Force any program to use your socks5 proxy server.
 Options:
   -q                         Quiet mode
   -c config                  Specify config file to use (Default: %s)
+  -p [ip:]port:port[/proto]  Forward a host port to the tun ip in the namespace, can be repeated (overrides port_forwards)
 
 These options override settings in config file:
   --tun-name=<TUN_NAME>                        Set tun device name
   --tun-ip=<TUN_IP>                            Set tun device IPv4 address
   --tun-ip6=<TUN_IP6>                          Set tun device IPv6 address (optional)
+  --proxy-type=<PROXY_TYPE>                    Set proxy type: socks5, socks4, socks4a, http or shadowsocks (optional) (Default: socks5)
   --socks5-address=<SOCKS5_ADDRESS>            Use the specified proxy
   --username=<SOCKS5_USER>                     Username of the specified proxy (optional)
   --password=<SOCKS5_PASS>                     Password of the specified proxy (optional)
+  --cipher=<CIPHER>                            Cipher of the specified shadowsocks proxy (optional)
+  --socks5-bind=<BOOL>                         Accept inbound connections for listeners with SOCKS5 BIND (optional) (Default: false)
   --fake-dns=<BOOL>                            Enable/Disable fake DNS
   --fake-network=<NETWORK>                     Set network used for fake DNS
+  --fake-network6=<NETWORK>                    Set IPv6 network used for fake DNS (optional)
   --dns-server=<DNS_SERVER>                    Set DNS server(only available when fake DNS is disabled)
   --udp-session-timeout=<UDP_SESSION_TIMEOUT>  Set UDP session timeout (optional) (Default: %s)
+  --udp-over-tcp=<MODE>                        Relay UDP over TCP if the proxy doesn't support UDP: off, dns or uot (optional) (Default: dns)
 `, os.Args[0], buildconfig.ConfigPath, config.UDPSessionTimeout)
 }
 
+// stringsFlag collects the values of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func isFlagPresent(name string) (present bool) {
 	flag.Visit(func(f *flag.Flag) {
 		if f.Name == name {
@@ -64,19 +87,26 @@ func isFlagPresent(name string) (present bool) {
 func main() {
 	quietMode := flag.Bool("q", false, "")
 	cfgPath := flag.String("c", buildconfig.ConfigPath, "")
+	var portForwards stringsFlag
+	flag.Var(&portForwards, "p", "")
 	tunName := flag.String("tun-name", "", "")
 	tunIp := flag.String("tun-ip", "", "")
 	tunIp6 := flag.String("tun-ip6", "", "")
+	proxyType := flag.String("proxy-type", "", "")
 	socks5Address := flag.String("socks5-address", "", "")
 	username := flag.String("username", "", "")
 	password := flag.String("password", "", "")
+	cipher := flag.String("cipher", "", "")
 	// See https://pkg.go.dev/flag
 	// Boolean flags are not permitted to be written in the form
 	// like "--fake-dns false"
+	socks5Bind := flag.String("socks5-bind", "false", "")
 	fakeDns := flag.String("fake-dns", "true", "")
 	fakeNetwork := flag.String("fake-network", "", "")
+	fakeNetwork6 := flag.String("fake-network6", "", "")
 	dnsServer := flag.String("dns-server", "", "")
 	udpSessionTimeout := flag.Duration("udp-session-timeout", config.UDPSessionTimeout, "")
+	udpOverTCP := flag.String("udp-over-tcp", "", "")
 	daemon := flag.Bool("daemon", false, "")
 	flag.CommandLine.Usage = usage
 	flag.Parse()
@@ -126,6 +156,9 @@ func main() {
 	if isFlagPresent("tun-ip6") {
 		data.TunIP6 = tunIp6
 	}
+	if isFlagPresent("proxy-type") {
+		data.ProxyType = proxyType
+	}
 	if isFlagPresent("socks5-address") {
 		data.Socks5Address = socks5Address
 	}
@@ -135,6 +168,17 @@ func main() {
 	if isFlagPresent("password") {
 		data.Password = password
 	}
+	if isFlagPresent("cipher") {
+		data.Cipher = cipher
+	}
+	if isFlagPresent("socks5-bind") {
+		socks5BindBool, err := strconv.ParseBool(*socks5Bind)
+		if err != nil {
+			usage()
+			os.Exit(1)
+		}
+		data.Socks5Bind = &socks5BindBool
+	}
 	if isFlagPresent("fake-dns") {
 		fakeDnsBool, err := strconv.ParseBool(*fakeDns)
 		if err != nil {
@@ -146,6 +190,9 @@ func main() {
 	if isFlagPresent("fake-network") {
 		data.FakeNetwork = fakeNetwork
 	}
+	if isFlagPresent("fake-network6") {
+		data.FakeNetwork6 = fakeNetwork6
+	}
 	if isFlagPresent("dns-server") {
 		data.DNSServer = dnsServer
 	}
@@ -153,11 +200,22 @@ func main() {
 		s := udpSessionTimeout.String()
 		data.UDPSessionTimeout = &s
 	}
+	if isFlagPresent("udp-over-tcp") {
+		data.UDPOverTCP = udpOverTCP
+	}
+	if isFlagPresent("p") {
+		data.PortForwards = (*[]string)(&portForwards)
+	}
 	err = cfg.Update(data)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+	err = cfg.Validate()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 
 	if err := runMain(cfg, args); err != nil {
 		log.Println(err)
@@ -192,7 +250,7 @@ func runDaemon() error {
 		return fmt.Errorf("Failed to drop privileges: %w", err)
 	}
 
-	pipeFd, tunFd, pidFd, packetConnFd := 3, 4, 5, 6
+	pipeFd, tunFd, pidFd, packetConnFd, listenerFd, forwardFd := 3, 4, 5, 6, 7, 8
 
 	pipeFile := os.NewFile(uintptr(pipeFd), "")
 
@@ -206,30 +264,98 @@ func runDaemon() error {
 	cfg := data.Config
 
 	config.UDPSessionTimeout = cfg.UDPSessionTimeout
+	config.HandshakeTimeout = cfg.HandshakeTimeout
+	config.UDPAssociateTimeout = cfg.UDPAssociateTimeout
 
 	var fakeDNSServer *fakedns.Server
 
-	socks5Client := proxy.SOCKS5("tcp", cfg.Socks5Address, cfg.Username, cfg.Password)
+	dialer, named, err := newDialer(cfg)
+	if err != nil {
+		return fmt.Errorf("Failed to create proxy dialer: %w", err)
+	}
 
 	if cfg.FakeDNS {
 		packetConn, err := net.FilePacketConn(os.NewFile(uintptr(packetConnFd), ""))
 		if err != nil {
 			return fmt.Errorf("Failed to get PacketConn: %w", err)
 		}
-		fakeDNSServer = fakedns.NewServer(packetConn, socks5Client, net.JoinHostPort(cfg.DNSServer, "53"), cfg.FakeNetwork)
+		// Fake IPv6 addresses are unreachable without IPv6 routing.
+		var fakeNetwork6 *net.IPNet
+		if cfg.TunIP6 != nil {
+			fakeNetwork6 = cfg.FakeNetwork6
+		}
+		fakeDNSServer = fakedns.NewServer(packetConn, dialer, net.JoinHostPort(cfg.DNSServer, "53"), cfg.ConnectTimeout+cfg.HandshakeTimeout, cfg.FakeNetwork, fakeNetwork6, cfg.FakeDNSTTL, cfg.FakeDNSMaxEntries, cfg.FakeDNSAllocation == "hash")
+		fakeDNSServer.SetTCPFallback(cfg.UDPOverTCP != "off")
 		go func() {
 			err := fakeDNSServer.Run()
 			if err != nil {
 				log.Printf("Failed to start FakeDNS server: %s\n", err)
 			}
 		}()
+		listener, err := net.FileListener(os.NewFile(uintptr(listenerFd), ""))
+		if err != nil {
+			return fmt.Errorf("Failed to get Listener: %w", err)
+		}
+		go func() {
+			err := fakeDNSServer.RunTCP(listener)
+			if err != nil {
+				log.Printf("Failed to start FakeDNS TCP server: %s\n", err)
+			}
+		}()
 	}
 
-	err = manageTun(tunMTU, tunFd, socks5Client, fakeDNSServer)
+	var tcpResolver, udpResolver proxy.Resolver
+	if cfg.ResolveTCP || cfg.ResolveUDP {
+		var resolver proxy.Resolver
+		switch cfg.Resolver {
+		case "dns":
+			resolver = proxy.DNSOverTCP(dialer, net.JoinHostPort(cfg.DNSServer, "53"))
+		case "socks5":
+			// config ensures a SOCKS5 upstream, which supports
+			// RESOLVE.
+			resolver = dialer.(proxy.Resolver)
+		}
+		resolver = proxy.NewResolverCache(resolver, cfg.ResolveCacheTTL)
+		if cfg.ResolveTCP {
+			tcpResolver = resolver
+		}
+		if cfg.ResolveUDP {
+			udpResolver = resolver
+		}
+	}
+
+	retry := proxy.Retry{
+		Attempts:   cfg.RetryAttempts,
+		Backoff:    cfg.RetryBackoff,
+		MaxBackoff: cfg.RetryMaxBackoff,
+	}
+	for _, code := range cfg.RetryReplies {
+		retry.Replies = append(retry.Replies, socks5.Reply(code))
+	}
+
+	router, err := newRouter(cfg, dialer, named)
+	if err != nil {
+		return fmt.Errorf("Failed to create router: %w", err)
+	}
+
+	tunStack, err := manageTun(tunMTU, tunFd, router, retry, tcpResolver, udpResolver, fakeDNSServer)
 	if err != nil {
 		return fmt.Errorf("Failed to manage TUN: %w", err)
 	}
 
+	if cfg.Socks5Bind {
+		// config ensures a SOCKS5 upstream, which supports BIND.
+		go manageBind(tunStack, dialer.(proxy.Binder), data.Pid, cfg.TunIP, cfg.TunIP6)
+	}
+
+	forwardSrc := forwardSource(cfg)
+	for i, forward := range cfg.PortForwards {
+		f := os.NewFile(uintptr(forwardFd+i), "")
+		if err := manageForward(tunStack, forward, f, cfg.TunIP, forwardSrc); err != nil {
+			return fmt.Errorf("Failed to forward %s: %w", forward, err)
+		}
+	}
+
 	for {
 		_, err = unix.Poll([]unix.PollFd{
 			{
@@ -266,8 +392,13 @@ func runMain(cfg *config.Config, args []string) error {
 		packetConn     net.PacketConn
 		packetConnFile *os.File
 
+		listener     net.Listener
+		listenerFile *os.File
+
 		tempFile, nullFile *os.File
 
+		forwardFiles []*os.File
+
 		wd string
 
 		tunFd, pidFd int
@@ -279,6 +410,13 @@ func runMain(cfg *config.Config, args []string) error {
 
 		err error
 	)
+	// The daemon loads rule sets again, they're checked here so that a
+	// missing or malformed file fails before the program starts.
+	_, err = route.New(cfg.Rules, cfg.RuleSets)
+	if err != nil {
+		return fmt.Errorf("Failed to load rules: %w", err)
+	}
+
 	runtime.LockOSThread()
 	originMntNs, err = getNs("mnt")
 	if err != nil {
@@ -369,6 +507,15 @@ func runMain(cfg *config.Config, args []string) error {
 		if err != nil {
 			return fmt.Errorf("Failed to get DNS server listener fd: %w", err)
 		}
+		// Resolvers fall back to TCP for truncated responses.
+		listener, err = net.Listen("tcp", net.JoinHostPort(dnsServer, "53"))
+		if err != nil {
+			return fmt.Errorf("DNS server failed to listen on TCP: %w", err)
+		}
+		listenerFile, err = listener.(*net.TCPListener).File()
+		if err != nil {
+			return fmt.Errorf("Failed to get DNS server TCP listener fd: %w", err)
+		}
 	}
 
 	err = netlink.LinkAdd(&netlink.Tuntap{
@@ -461,6 +608,16 @@ func runMain(cfg *config.Config, args []string) error {
 		return fmt.Errorf("Failed to enter origin mount namespace: %w", err)
 	}
 
+	// Listen in the origin network namespace, before the capabilities
+	// are dropped.
+	for _, forward := range cfg.PortForwards {
+		f, err := listenForward(forward)
+		if err != nil {
+			return fmt.Errorf("Failed to listen for port forward %s: %w", forward, err)
+		}
+		forwardFiles = append(forwardFiles, f)
+	}
+
 	execName, err = os.Executable()
 	if err != nil {
 		return fmt.Errorf("Failed to get executable path: %w", err)
@@ -471,6 +628,7 @@ func runMain(cfg *config.Config, args []string) error {
 	}
 	if !cfg.FakeDNS {
 		packetConnFile = nullFile
+		listenerFile = nullFile
 	}
 	r, w, err = os.Pipe()
 	if err != nil {
@@ -479,12 +637,13 @@ func runMain(cfg *config.Config, args []string) error {
 	daemonArgs = slices.Insert(slices.Clone(os.Args), 1, "--daemon")
 	_, err = os.StartProcess(execName, daemonArgs, &os.ProcAttr{
 		Dir: "/",
-		Files: []*os.File{
+		Files: append([]*os.File{
 			nullFile, nullFile, os.Stderr, r,
 			os.NewFile(uintptr(tunFd), ""),
 			os.NewFile(uintptr(pidFd), ""),
 			packetConnFile,
-		},
+			listenerFile,
+		}, forwardFiles...),
 		Sys: &syscall.SysProcAttr{
 			Setsid: true,
 		},
@@ -494,6 +653,7 @@ func runMain(cfg *config.Config, args []string) error {
 	}
 	err = gob.NewEncoder(w).Encode(&Data{
 		TunMTU: tunMTU,
+		Pid:    os.Getpid(),
 		Config: cfg,
 	})
 	if err != nil {
@@ -1,7 +1,63 @@
 package proxy
 
-import "net"
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"proxy-ns/proxy/transport/socks5"
+)
 
 type Dialer interface {
-	Dial(network, address string) (net.Conn, error)
+	// DialContext connects to address. Once the connection is
+	// established, ctx doesn't affect it.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// UDPRelay dials UDP connections sharing the same relay, so that
+// packets from different targets are mapped to the same local
+// endpoint. (Endpoint Independent Mapping)
+type UDPRelay interface {
+	Dial(address string) (net.Conn, error)
+	// SetFinalizer sets a function called when the relay is closed.
+	SetFinalizer(f func())
+}
+
+// UDPAssociator is implemented by Dialers which can relay UDP packets.
+type UDPAssociator interface {
+	UDPAssociate(ctx context.Context) (UDPRelay, error)
+}
+
+// Direct is a Dialer which connects directly.
+var Direct Dialer = &net.Dialer{}
+
+// Prober is implemented by Dialers which can check whether the proxy
+// server works, without connecting to any target.
+type Prober interface {
+	Probe(ctx context.Context) error
+}
+
+// probeServer checks whether the proxy server at address accepts
+// connections through forward.
+func probeServer(ctx context.Context, forward Dialer, network, address string) error {
+	conn, err := forward.DialContext(ctx, network, address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	return conn.Close()
+}
+
+// Binder is implemented by Dialers which can accept an inbound
+// connection on the proxy server. The returned Listener accepts only one
+// connection from addr, its Addr is the address on the proxy server. addr
+// is a SOCKS5 address, as the address of all zeros for an unknown peer
+// isn't a valid host and port.
+type Binder interface {
+	Bind(ctx context.Context, addr socks5.Addr) (net.Listener, error)
+}
+
+// Resolver is implemented by Dialers which can resolve domain names on
+// the proxy server.
+type Resolver interface {
+	Resolve(ctx context.Context, host string) (net.IP, error)
 }
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-ns/config"
+	"proxy-ns/network"
+)
+
+// DirectUDP is a UDPAssociator which sends UDP packets directly.
+var DirectUDP UDPAssociator = directAssociator{}
+
+type directAssociator struct{}
+
+// UDPAssociate returns a relay sending packets from a single local
+// socket, so that packets from different targets are mapped to the same
+// local endpoint.
+func (directAssociator) UDPAssociate(ctx context.Context) (UDPRelay, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return &directRelay{pc: pc}, nil
+}
+
+type directRelay struct {
+	pc        net.PacketConn
+	once      sync.Once
+	buffers   sync.Map // map[netip.AddrPort]*socketBuffer
+	count     atomic.Int64
+	finalizer func()
+}
+
+func (r *directRelay) Dial(address string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		// Finalize the relay if it's never used.
+		r.Add(0)
+		return nil, err
+	}
+	key := unmapAddrPort(addr.AddrPort())
+	actual, _ := r.buffers.LoadOrStore(key, newSocketBuffer(config.UDPSessionTimeout))
+	go r.once.Do(r.poll)
+	r.Add(1)
+	return &directConn{
+		relay:  r,
+		addr:   addr,
+		key:    key,
+		buffer: actual.(*socketBuffer),
+	}, nil
+}
+
+func (r *directRelay) poll() {
+	buf := make([]byte, network.MaxPacketSize)
+	for {
+		n, addr, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := unmapAddrPort(addr.(*net.UDPAddr).AddrPort())
+		value, ok := r.buffers.Load(key)
+		if ok {
+			value.(*socketBuffer).Write(buf[:n])
+		} else {
+			// gvisor's udp.NewForwarder cannot handle unrelated packet.
+			log.Println("Failed to associate packet from:", addr)
+		}
+	}
+}
+
+func (r *directRelay) Add(delta int64) {
+	if r.count.Add(delta) == 0 {
+		r.pc.Close()
+		if r.finalizer != nil {
+			r.finalizer()
+		}
+	}
+}
+
+func (r *directRelay) SetFinalizer(f func()) {
+	r.finalizer = f
+}
+
+// directConn reads packets from addr buffered by the relay, reads time
+// out after config.UDPSessionTimeout.
+type directConn struct {
+	relay  *directRelay
+	addr   *net.UDPAddr
+	key    netip.AddrPort
+	buffer *socketBuffer
+	once   sync.Once
+}
+
+func (c *directConn) Read(p []byte) (int, error) {
+	return c.buffer.Read(p)
+}
+
+func (c *directConn) Write(p []byte) (int, error) {
+	return c.relay.pc.WriteTo(p, c.addr)
+}
+
+func (c *directConn) Close() error {
+	c.once.Do(func() {
+		c.relay.buffers.Delete(c.key)
+		c.relay.Add(-1)
+	})
+	return nil
+}
+
+func (c *directConn) LocalAddr() net.Addr  { return c.relay.pc.LocalAddr() }
+func (c *directConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *directConn) SetDeadline(t time.Time) error      { return nil }
+func (c *directConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *directConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
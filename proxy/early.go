@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// earlyDataTimeout is how long the first write is waited for, before
+// connecting without early data.
+const earlyDataTimeout = 50 * time.Millisecond
+
+// earlyDataConn defers connect until the first Write, so that the
+// written data is sent along with the handshake. If nothing is written
+// within earlyDataTimeout, e.g. for protocols where the server speaks
+// first, it connects on Read without data.
+type earlyDataConn struct {
+	connect func(payload []byte) (net.Conn, error)
+	once    sync.Once
+	done    chan struct{}
+	conn    net.Conn
+	err     error
+
+	mutex         sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newEarlyDataConn(connect func(payload []byte) (net.Conn, error)) *earlyDataConn {
+	return &earlyDataConn{
+		connect: connect,
+		done:    make(chan struct{}),
+	}
+}
+
+// handshake connects with payload, it reports whether this call did it.
+func (c *earlyDataConn) handshake(payload []byte) (first bool) {
+	c.once.Do(func() {
+		first = true
+		conn, err := c.connect(payload)
+		c.mutex.Lock()
+		c.conn, c.err = conn, err
+		if conn != nil {
+			conn.SetReadDeadline(c.readDeadline)
+			conn.SetWriteDeadline(c.writeDeadline)
+		}
+		c.mutex.Unlock()
+		close(c.done)
+	})
+	return first
+}
+
+func (c *earlyDataConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.done:
+	case <-time.After(earlyDataTimeout):
+		c.handshake(nil)
+		<-c.done
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Read(p)
+}
+
+func (c *earlyDataConn) Write(p []byte) (int, error) {
+	if c.handshake(p) {
+		if c.err != nil {
+			return 0, c.err
+		}
+		return len(p), nil
+	}
+	<-c.done
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Write(p)
+}
+
+func (c *earlyDataConn) Close() error {
+	c.once.Do(func() {
+		c.err = net.ErrClosed
+		close(c.done)
+	})
+	<-c.done
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+func (c *earlyDataConn) LocalAddr() net.Addr {
+	select {
+	case <-c.done:
+		if c.conn != nil {
+			return c.conn.LocalAddr()
+		}
+	default:
+	}
+	return nil
+}
+
+func (c *earlyDataConn) RemoteAddr() net.Addr {
+	select {
+	case <-c.done:
+		if c.conn != nil {
+			return c.conn.RemoteAddr()
+		}
+	default:
+	}
+	return nil
+}
+
+func (c *earlyDataConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *earlyDataConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *earlyDataConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
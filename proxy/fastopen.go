@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// FastOpenControl enables TCP Fast Open on sockets of a net.Dialer, so
+// that the first write is sent along with SYN when the server supports
+// it. It behaves like a plain net.Dialer otherwise.
+func FastOpenControl(network, address string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-ns/proxy/transport/socks5"
+)
+
+// HealthCheck configures background health checks of Group members.
+type HealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Target is connected through members if set, otherwise members
+	// implementing Prober are probed.
+	Target string
+}
+
+// Policy decides which healthy member a new flow goes through.
+type Policy string
+
+const (
+	// PolicyFailover selects the first healthy member.
+	PolicyFailover Policy = "failover"
+	// PolicyRoundRobin selects healthy members in turn.
+	PolicyRoundRobin Policy = "round-robin"
+	// PolicyLeastConn selects the healthy member with the least
+	// active connections.
+	PolicyLeastConn Policy = "least-conn"
+	// PolicyLatency selects the healthy member with the lowest health
+	// check latency.
+	PolicyLatency Policy = "latency"
+	// PolicyConsistentHash selects a healthy member by hashing the
+	// destination host, so that flows to the same host stick to the
+	// same member.
+	PolicyConsistentHash Policy = "consistent-hash"
+)
+
+type groupMember struct {
+	name     string
+	dialer   Dialer
+	healthy  atomic.Bool
+	checking atomic.Bool
+	active   atomic.Int64
+	// latency is the smoothed health check latency in nanoseconds,
+	// 0 if not measured yet.
+	latency atomic.Int64
+}
+
+// Group dials through healthy members selected by Policy, so that new
+// connections fail over to another proxy server when one goes down.
+// Established connections stay on the member they were dialed through.
+type Group struct {
+	members     []*groupMember
+	policy      Policy
+	healthCheck HealthCheck
+	next        atomic.Uint64
+}
+
+func NewGroup(policy Policy, healthCheck HealthCheck) *Group {
+	return &Group{
+		policy:      policy,
+		healthCheck: healthCheck,
+	}
+}
+
+// Add adds a member to the group. Members added first are preferred.
+// It must not be called after Start.
+func (g *Group) Add(name string, dialer Dialer) {
+	m := &groupMember{
+		name:   name,
+		dialer: dialer,
+	}
+	m.healthy.Store(true)
+	g.members = append(g.members, m)
+}
+
+// Start checks members periodically in background.
+func (g *Group) Start() {
+	go func() {
+		ticker := time.NewTicker(g.healthCheck.Interval)
+		defer ticker.Stop()
+		for {
+			for _, m := range g.members {
+				go g.check(m)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func (g *Group) check(m *groupMember) {
+	if !m.checking.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.checking.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.healthCheck.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := g.probe(ctx, m)
+
+	healthy := err == nil
+	if healthy {
+		elapsed := int64(time.Since(start))
+		if old := m.latency.Load(); old != 0 {
+			elapsed = (old*3 + elapsed) / 4
+		}
+		m.latency.Store(elapsed)
+	}
+	if m.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Printf("upstream %s is up\n", m.name)
+		} else {
+			log.Printf("upstream %s is down: %s\n", m.name, err)
+		}
+	}
+}
+
+func (g *Group) probe(ctx context.Context, m *groupMember) error {
+	if g.healthCheck.Target != "" {
+		conn, err := m.dialer.DialContext(ctx, "tcp", g.healthCheck.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if prober, ok := m.dialer.(Prober); ok {
+		return prober.Probe(ctx)
+	}
+	return nil
+}
+
+// pick returns a member accepted by filter for a flow to address,
+// according to the policy. If none of them is healthy, unhealthy
+// members are considered instead.
+func (g *Group) pick(filter func(m *groupMember) bool, address string) *groupMember {
+	var healthy, all []*groupMember
+	for _, m := range g.members {
+		if !filter(m) {
+			continue
+		}
+		all = append(all, m)
+		if m.healthy.Load() {
+			healthy = append(healthy, m)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = all
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch g.policy {
+	case PolicyRoundRobin:
+		return candidates[(g.next.Add(1)-1)%uint64(len(candidates))]
+	case PolicyLeastConn:
+		selected := candidates[0]
+		for _, m := range candidates[1:] {
+			if m.active.Load() < selected.active.Load() {
+				selected = m
+			}
+		}
+		return selected
+	case PolicyLatency:
+		selected := candidates[0]
+		for _, m := range candidates[1:] {
+			latency := m.latency.Load()
+			if latency != 0 && (selected.latency.Load() == 0 || latency < selected.latency.Load()) {
+				selected = m
+			}
+		}
+		return selected
+	case PolicyConsistentHash:
+		if address == "" {
+			return candidates[0]
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		// Rendezvous hashing: only flows on a member going down
+		// are moved to other members.
+		var (
+			selected *groupMember
+			maxScore uint64
+		)
+		for _, m := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(m.name))
+			h.Write([]byte{0})
+			h.Write([]byte(host))
+			if score := h.Sum64(); selected == nil || score > maxScore {
+				selected, maxScore = m, score
+			}
+		}
+		return selected
+	default:
+		return candidates[0]
+	}
+}
+
+func (g *Group) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	m := g.pick(func(*groupMember) bool { return true }, address)
+	if m == nil {
+		return nil, errors.New("no upstream available")
+	}
+	log.Printf("%s %s via upstream %s\n", network, address, m.name)
+	conn, err := m.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		// Check the member now, instead of waiting for the next round.
+		// A cancelled dial says nothing about the member.
+		if ctx.Err() == nil {
+			go g.check(m)
+		}
+		return nil, fmt.Errorf("upstream %s: %w", m.name, err)
+	}
+	m.active.Add(1)
+	return &groupConn{Conn: conn, member: m}, nil
+}
+
+// connectAddr selects a member which can connect to addr directly.
+func (g *Group) connectAddr(ctx context.Context, addr socks5.Addr) (net.Conn, error) {
+	m := g.pick(func(m *groupMember) bool {
+		_, ok := m.dialer.(addrConnector)
+		return ok
+	}, addr.String())
+	if m == nil {
+		return nil, fmt.Errorf("no upstream can connect to %s", addr)
+	}
+	log.Printf("tcp %s via upstream %s\n", addr, m.name)
+	conn, err := m.dialer.(addrConnector).connectAddr(ctx, addr)
+	if err != nil {
+		if ctx.Err() == nil {
+			go g.check(m)
+		}
+		return nil, fmt.Errorf("upstream %s: %w", m.name, err)
+	}
+	m.active.Add(1)
+	return &groupConn{Conn: conn, member: m}, nil
+}
+
+// UDPAssociate selects a member supporting UDP. A relay serves flows to
+// different destinations, so it's not hashed by PolicyConsistentHash.
+func (g *Group) UDPAssociate(ctx context.Context) (UDPRelay, error) {
+	m := g.pick(func(m *groupMember) bool {
+		_, ok := m.dialer.(UDPAssociator)
+		return ok
+	}, "")
+	if m == nil {
+		return nil, errors.New("no upstream supports UDP")
+	}
+	log.Printf("udp-associate via upstream %s\n", m.name)
+	relay, err := m.dialer.(UDPAssociator).UDPAssociate(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			go g.check(m)
+		}
+		return nil, fmt.Errorf("upstream %s: %w", m.name, err)
+	}
+	m.active.Add(1)
+	r := &groupRelay{UDPRelay: relay, member: m}
+	r.SetFinalizer(nil)
+	return r, nil
+}
+
+// groupConn tracks active connections of member.
+type groupConn struct {
+	net.Conn
+	member *groupMember
+	once   sync.Once
+}
+
+func (c *groupConn) Close() error {
+	c.once.Do(func() {
+		c.member.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// groupRelay tracks active relays of member.
+type groupRelay struct {
+	UDPRelay
+	member *groupMember
+}
+
+func (r *groupRelay) SetFinalizer(f func()) {
+	r.UDPRelay.SetFinalizer(func() {
+		r.member.active.Add(-1)
+		if f != nil {
+			f()
+		}
+	})
+}
+
+// Bind selects a member supporting BIND.
+func (g *Group) Bind(ctx context.Context, addr socks5.Addr) (net.Listener, error) {
+	m := g.pick(func(m *groupMember) bool {
+		_, ok := m.dialer.(Binder)
+		return ok
+	}, "")
+	if m == nil {
+		return nil, errors.New("no upstream supports BIND")
+	}
+	ln, err := m.dialer.(Binder).Bind(ctx, addr)
+	if err != nil {
+		if ctx.Err() == nil {
+			go g.check(m)
+		}
+		return nil, fmt.Errorf("upstream %s: %w", m.name, err)
+	}
+	return ln, nil
+}
+
+// Resolve selects a member supporting RESOLVE.
+func (g *Group) Resolve(ctx context.Context, host string) (net.IP, error) {
+	m := g.pick(func(m *groupMember) bool {
+		_, ok := m.dialer.(Resolver)
+		return ok
+	}, "")
+	if m == nil {
+		return nil, errors.New("no upstream supports RESOLVE")
+	}
+	ip, err := m.dialer.(Resolver).Resolve(ctx, host)
+	if err != nil {
+		if ctx.Err() == nil {
+			go g.check(m)
+		}
+		return nil, fmt.Errorf("upstream %s: %w", m.name, err)
+	}
+	return ip, nil
+}
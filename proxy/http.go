@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"proxy-ns/config"
+	"proxy-ns/proxy/transport/http"
+)
+
+type HTTPClient struct {
+	network string
+	address string
+	auth    *http.Auth
+	forward Dialer
+
+	// scheme is the last authentication scheme accepted by the
+	// proxy, it's used first for new connections to save roundtrips.
+	scheme atomic.Uint32
+}
+
+type HTTPError struct {
+	// Addr is the network address for which this error occurred.
+	Addr string
+
+	// Err is the error that occurred during the operation.
+	// The Error method panics if the error is nil.
+	Err error
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HTTPError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	s := "http connect"
+	if e.Addr != "" {
+		s += " " + e.Addr
+	}
+	s += ": " + e.Err.Error()
+	return s
+}
+
+// HTTP returns a HTTPClient connecting to address through forward.
+// If forward is nil, Direct is used.
+func HTTP(network, address, username, password string, forward Dialer) *HTTPClient {
+	if forward == nil {
+		forward = Direct
+	}
+	if username != "" && password != "" {
+		return &HTTPClient{
+			network: network,
+			address: address,
+			auth: &http.Auth{
+				Username: username,
+				Password: password,
+			},
+			forward: forward,
+		}
+	}
+	return &HTTPClient{
+		network: network,
+		address: address,
+		auth:    nil,
+		forward: forward,
+	}
+}
+
+func (d *HTTPClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.Connect(ctx, address)
+	default:
+		return nil, fmt.Errorf("network not implemented: %s", network)
+	}
+}
+
+// Probe checks whether the server accepts connections.
+func (d *HTTPClient) Probe(ctx context.Context) error {
+	return probeServer(ctx, d.forward, d.network, d.address)
+}
+
+func (d *HTTPClient) Connect(ctx context.Context, address string) (net.Conn, error) {
+	if _, _, err := splitHostPort(address); err != nil {
+		return nil, &HTTPError{
+			Addr: address,
+			Err:  fmt.Errorf("invalid address: %w", err),
+		}
+	}
+
+	scheme := http.Scheme(d.scheme.Load())
+	for {
+		conn, err := d.forward.DialContext(ctx, d.network, d.address)
+		if err != nil {
+			return nil, &HTTPError{
+				Addr: address,
+				Err:  fmt.Errorf("failed to connect to %s: %w", d.address, err),
+			}
+		}
+
+		var c net.Conn
+		var accepted http.Scheme
+		err = handshake(ctx, conn, config.HandshakeTimeout, func() (err error) {
+			c, accepted, err = http.ClientHandshake(conn, address, d.auth, scheme)
+			return err
+		})
+		if err != nil {
+			conn.Close()
+			var retryErr *http.RetryError
+			if errors.As(err, &retryErr) && retryErr.Scheme != scheme {
+				scheme = retryErr.Scheme
+				continue
+			}
+			return nil, &HTTPError{
+				Addr: address,
+				Err:  fmt.Errorf("failed to perform client handshake: %w", err),
+			}
+		}
+		d.scheme.Store(uint32(accepted))
+		return c, nil
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Pool configures connections dialed to the proxy server in advance.
+type Pool struct {
+	// Size is the number of idle connections kept, 0 disables the pool.
+	Size int
+	// IdleTimeout is how long an idle connection is kept before it's
+	// replaced, as servers may close idle connections.
+	IdleTimeout time.Duration
+	// CheckInterval is how often idle connections are checked and
+	// replenished.
+	CheckInterval time.Duration
+}
+
+type pooledConn struct {
+	net.Conn
+	created time.Time
+}
+
+// connPool keeps connections returned by dial, which are handed out once.
+type connPool struct {
+	dial        func() (net.Conn, error)
+	idleTimeout time.Duration
+	interval    time.Duration
+	conns       chan *pooledConn
+	refill      chan struct{}
+}
+
+func newConnPool(dial func() (net.Conn, error), pool Pool) *connPool {
+	p := &connPool{
+		dial:        dial,
+		idleTimeout: pool.IdleTimeout,
+		interval:    pool.CheckInterval,
+		conns:       make(chan *pooledConn, pool.Size),
+		refill:      make(chan struct{}, 1),
+	}
+	go p.run()
+	return p
+}
+
+// Get returns an idle connection, or nil if there is none.
+func (p *connPool) Get() net.Conn {
+	defer func() {
+		select {
+		case p.refill <- struct{}{}:
+		default:
+		}
+	}()
+	for {
+		select {
+		case c := <-p.conns:
+			if p.usable(c) {
+				return c.Conn
+			}
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *connPool) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.check()
+		p.fill()
+		select {
+		case <-ticker.C:
+		case <-p.refill:
+		}
+	}
+}
+
+// check closes idle connections which are expired or closed by the
+// server.
+func (p *connPool) check() {
+	for n := len(p.conns); n > 0; n-- {
+		select {
+		case c := <-p.conns:
+			if !p.usable(c) {
+				c.Close()
+				continue
+			}
+			select {
+			case p.conns <- c:
+			default:
+				c.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// fill dials connections until the pool is full. It gives up on the
+// first failure, until the next check.
+func (p *connPool) fill() {
+	for len(p.conns) < cap(p.conns) {
+		conn, err := p.dial()
+		if err != nil {
+			return
+		}
+		select {
+		case p.conns <- &pooledConn{Conn: conn, created: time.Now()}:
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (p *connPool) usable(c *pooledConn) bool {
+	return time.Since(c.created) < p.idleTimeout && connAlive(c.Conn)
+}
+
+// connAlive reports whether conn is still open. The server isn't
+// expected to send anything on an idle connection.
+func connAlive(conn net.Conn) bool {
+	// A short deadline rather than a past one, which would fail the read
+	// before checking the connection.
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
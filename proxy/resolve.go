@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"proxy-ns/config"
+)
+
+// DNSResolver resolves domain names with DNS over TCP, connecting to the
+// DNS server through forward.
+type DNSResolver struct {
+	forward Dialer
+	server  string
+}
+
+// DNSOverTCP returns a DNSResolver querying server through forward.
+func DNSOverTCP(forward Dialer, server string) *DNSResolver {
+	return &DNSResolver{
+		forward: forward,
+		server:  server,
+	}
+}
+
+// Resolve returns an IPv4 address of host, or an IPv6 address if it has
+// no IPv4 address.
+func (r *DNSResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	conn, err := r.forward.DialContext(ctx, "tcp", r.server)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: failed to connect to %s: %w", host, r.server, err)
+	}
+	defer conn.Close()
+
+	var ip net.IP
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() (err error) {
+		ip, err = r.exchange(&dns.Conn{Conn: conn}, host)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	return ip, nil
+}
+
+func (r *DNSResolver) exchange(co *dns.Conn, host string) (net.IP, error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg).SetQuestion(dns.Fqdn(host), qtype)
+		if err := co.WriteMsg(m); err != nil {
+			return nil, err
+		}
+		reply, err := co.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if reply.Id != m.Id {
+			return nil, dns.ErrId
+		}
+		if reply.Rcode != dns.RcodeSuccess {
+			return nil, errors.New(dns.RcodeToString[reply.Rcode])
+		}
+		for _, rr := range reply.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				return rr.A, nil
+			case *dns.AAAA:
+				return rr.AAAA, nil
+			}
+		}
+	}
+	return nil, errors.New("no address found")
+}
+
+// ResolverCache caches addresses resolved by Resolver for ttl.
+type ResolverCache struct {
+	resolver Resolver
+	ttl      time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*resolverCacheEntry
+}
+
+type resolverCacheEntry struct {
+	once    sync.Once
+	ip      net.IP
+	err     error
+	expires time.Time
+}
+
+// maxResolverCacheEntries is the number of entries above which expired
+// entries are removed.
+const maxResolverCacheEntries = 1024
+
+func NewResolverCache(resolver Resolver, ttl time.Duration) *ResolverCache {
+	return &ResolverCache{
+		resolver: resolver,
+		ttl:      ttl,
+		entries:  make(map[string]*resolverCacheEntry),
+	}
+}
+
+// Resolve returns the cached address of host, or resolves it. Failures
+// are not cached, concurrent lookups of the same host are resolved once.
+func (c *ResolverCache) Resolve(ctx context.Context, host string) (net.IP, error) {
+	now := time.Now()
+	c.mutex.Lock()
+	entry, ok := c.entries[host]
+	if !ok || (!entry.expires.IsZero() && now.After(entry.expires)) {
+		if len(c.entries) >= maxResolverCacheEntries {
+			for h, e := range c.entries {
+				if !e.expires.IsZero() && now.After(e.expires) {
+					delete(c.entries, h)
+				}
+			}
+		}
+		entry = &resolverCacheEntry{}
+		c.entries[host] = entry
+	}
+	c.mutex.Unlock()
+
+	entry.once.Do(func() {
+		entry.ip, entry.err = c.resolver.Resolve(ctx, host)
+		c.mutex.Lock()
+		if entry.err != nil {
+			if c.entries[host] == entry {
+				delete(c.entries, host)
+			}
+		} else {
+			entry.expires = time.Now().Add(c.ttl)
+		}
+		c.mutex.Unlock()
+	})
+	return entry.ip, entry.err
+}
+
+// ResolveAddress replaces the host of address with its resolved address,
+// if it's a domain name.
+func ResolveAddress(ctx context.Context, resolver Resolver, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	ip, err := resolver.Resolve(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
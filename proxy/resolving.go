@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fallbackDelay is how long the connection to the preferred address
+// family is waited for, before racing the other family. RFC 8305
+// section 5
+const fallbackDelay = 250 * time.Millisecond
+
+// ResolvingDialer connects to host names through forward, with their
+// addresses resolved in background, so that changed DNS records are
+// used by new connections. IPv4 and IPv6 addresses are raced as
+// described in RFC 8305 (Happy Eyeballs).
+type ResolvingDialer struct {
+	forward  Dialer
+	interval time.Duration
+
+	mutex sync.Mutex
+	hosts map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	mutex sync.Mutex
+	ips   []net.IP
+}
+
+// Resolving returns a ResolvingDialer connecting through forward, which
+// resolves host names every interval after Start.
+func Resolving(forward Dialer, interval time.Duration) *ResolvingDialer {
+	return &ResolvingDialer{
+		forward:  forward,
+		interval: interval,
+		hosts:    make(map[string]*resolvedHost),
+	}
+}
+
+// Start resolves host names periodically in background.
+func (d *ResolvingDialer) Start() {
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			d.mutex.Lock()
+			hosts := make(map[string]*resolvedHost, len(d.hosts))
+			for host, h := range d.hosts {
+				hosts[host] = h
+			}
+			d.mutex.Unlock()
+			for host, h := range hosts {
+				d.refresh(context.Background(), host, h)
+			}
+		}
+	}()
+}
+
+func (d *ResolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil || !strings.HasPrefix(network, "tcp") {
+		return d.forward.DialContext(ctx, network, address)
+	}
+
+	d.mutex.Lock()
+	h, ok := d.hosts[host]
+	if !ok {
+		h = &resolvedHost{}
+		d.hosts[host] = h
+	}
+	d.mutex.Unlock()
+
+	h.mutex.Lock()
+	ips := h.ips
+	h.mutex.Unlock()
+	if ips == nil {
+		// Not resolved yet, or failed to resolve so far.
+		ips, _, err = d.refresh(ctx, host, h)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := d.race(ctx, network, ips, port)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// The addresses may have changed.
+		if ips, changed, _ := d.refresh(ctx, host, h); changed {
+			return d.race(ctx, network, ips, port)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// refresh resolves host, and reports whether its addresses changed.
+// Failures keep the last resolved addresses.
+func (d *ResolvingDialer) refresh(ctx context.Context, host string, h *resolvedHost) ([]net.IP, bool, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no address found for " + host)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err != nil {
+		if h.ips != nil {
+			log.Printf("Failed to resolve %s, keep using %v: %s\n", host, h.ips, err)
+			return h.ips, false, nil
+		}
+		return nil, false, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	changed := !slices.EqualFunc(ips, h.ips, net.IP.Equal)
+	if changed {
+		log.Printf("%s resolved to %v\n", host, ips)
+	}
+	h.ips = ips
+	return ips, changed, nil
+}
+
+// race connects to addresses of the preferred family in turn, and to
+// addresses of the other family after fallbackDelay, returning the
+// first established connection. Pending connections are cancelled
+// once one is established.
+func (d *ResolvingDialer) race(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		switch {
+		case network == "tcp4" && ip.To4() == nil, network == "tcp6" && ip.To4() != nil:
+		case (ip.To4() != nil) == (ips[0].To4() != nil):
+			primaries = append(primaries, ip)
+		default:
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(primaries) == 0 {
+		primaries, fallbacks = fallbacks, nil
+	}
+	if len(primaries) == 0 {
+		return nil, errors.New("no address of network " + network)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	dialSerial := func(ips []net.IP) {
+		var err error
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = d.forward.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				results <- result{conn: conn}
+				return
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		results <- result{err: err}
+	}
+
+	go dialSerial(primaries)
+	pending := 1
+	var timer <-chan time.Time
+	if len(fallbacks) != 0 {
+		timer = time.After(fallbackDelay)
+	}
+	var firstErr error
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			go dialSerial(fallbacks)
+			pending++
+			continue
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if timer == nil && pending > 0 {
+					// Close the connection losing the race.
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if timer != nil {
+				// Don't wait for the fallback if the preferred
+				// family fails.
+				timer = nil
+				go dialSerial(fallbacks)
+				pending++
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
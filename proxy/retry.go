@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+
+	"proxy-ns/proxy/transport/socks5"
+)
+
+// Retry configures retries of connections failing transiently.
+type Retry struct {
+	// Attempts is the maximum number of attempts, values below 2
+	// disable retries.
+	Attempts int
+	// Backoff is the delay before the first retry, it's doubled for
+	// each following retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+	// Replies are SOCKS5 replies which are retried. Other failures
+	// reported by proxy servers are not retried, while network errors
+	// always are.
+	Replies []socks5.Reply
+}
+
+// Dial connects to address through d, retrying with exponential backoff
+// and jitter until the attempts are used up or ctx is done.
+func (r Retry) Dial(ctx context.Context, d Dialer, network, address string) (net.Conn, error) {
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		conn, err := d.DialContext(ctx, network, address)
+		if err == nil || attempt >= r.Attempts || ctx.Err() != nil || !r.retryable(err) {
+			return conn, err
+		}
+
+		// Equal jitter: wait between half and the whole backoff.
+		delay := backoff/2 + rand.N(backoff/2+1)
+		log.Printf("%s %s: attempt %d failed, retrying in %s: %s\n", network, address, attempt, delay.Round(time.Millisecond), err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, r.MaxBackoff)
+	}
+}
+
+func (r Retry) retryable(err error) bool {
+	var rep socks5.Reply
+	if errors.As(err, &rep) {
+		return slices.Contains(r.Replies, rep)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
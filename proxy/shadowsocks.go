@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync/atomic"
+
+	"proxy-ns/proxy/transport/shadowsocks"
+	"proxy-ns/proxy/transport/socks5"
+)
+
+type ShadowsocksClient struct {
+	network string
+	address string
+	cipher  *shadowsocks.Cipher
+	forward Dialer
+}
+
+type ShadowsocksError struct {
+	// Net is the network of the relayed connection, such as "tcp"
+	// or "udp".
+	Net string
+
+	// Addr is the network address for which this error occurred.
+	Addr string
+
+	// Err is the error that occurred during the operation.
+	// The Error method panics if the error is nil.
+	Err error
+}
+
+func (e *ShadowsocksError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ShadowsocksError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	s := "shadowsocks " + e.Net
+	if e.Addr != "" {
+		s += " " + e.Addr
+	}
+	s += ": " + e.Err.Error()
+	return s
+}
+
+// Shadowsocks returns a ShadowsocksClient connecting to address through
+// forward. If forward is nil, Direct is used.
+func Shadowsocks(network, address, method, password string, forward Dialer) (*ShadowsocksClient, error) {
+	if forward == nil {
+		forward = Direct
+	}
+	cipher, err := shadowsocks.NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowsocksClient{
+		network: network,
+		address: address,
+		cipher:  cipher,
+		forward: forward,
+	}, nil
+}
+
+func (d *ShadowsocksClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.Connect(ctx, address)
+	case "udp", "udp4", "udp6":
+		relay, err := d.UDPAssociate(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create udp relay: %w", err)
+		}
+		return relay.Dial(address)
+	default:
+		return nil, fmt.Errorf("network not implemented: %s", network)
+	}
+}
+
+// Probe checks whether the server accepts connections.
+func (d *ShadowsocksClient) Probe(ctx context.Context) error {
+	return probeServer(ctx, d.forward, d.network, d.address)
+}
+
+func (d *ShadowsocksClient) Connect(ctx context.Context, address string) (net.Conn, error) {
+	addr, err := serializeAddr(address)
+	if err != nil {
+		return nil, &ShadowsocksError{
+			Net:  "tcp",
+			Addr: address,
+			Err:  fmt.Errorf("failed to serialize address: %w", err),
+		}
+	}
+	return d.connect(ctx, address, addr)
+}
+
+// connectAddr connects to addr, which may be outside of the addresses
+// accepted by Connect, such as uot.MagicAddress with port 0.
+func (d *ShadowsocksClient) connectAddr(ctx context.Context, addr socks5.Addr) (net.Conn, error) {
+	return d.connect(ctx, addr.String(), addr)
+}
+
+func (d *ShadowsocksClient) connect(ctx context.Context, address string, addr socks5.Addr) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
+	if err != nil {
+		return nil, &ShadowsocksError{
+			Net:  "tcp",
+			Addr: address,
+			Err:  fmt.Errorf("failed to connect to %s: %w", d.address, err),
+		}
+	}
+
+	conn = d.cipher.StreamConn(conn)
+	// The target address is sent as the beginning of the stream.
+	if _, err := conn.Write(addr); err != nil {
+		conn.Close()
+		return nil, &ShadowsocksError{
+			Net:  "tcp",
+			Addr: address,
+			Err:  fmt.Errorf("failed to send target address: %w", err),
+		}
+	}
+	return conn, nil
+}
+
+func (d *ShadowsocksClient) UDPAssociate(ctx context.Context) (UDPRelay, error) {
+	if d.network == "unix" {
+		return nil, &ShadowsocksError{
+			Net: "udp",
+			Err: errors.New("udp is not supported by server on unix socket"),
+		}
+	}
+	pc, relayAddr, err := listenRelay(ctx, d.forward, d.address)
+	if err != nil {
+		return nil, &ShadowsocksError{
+			Net: "udp",
+			Err: err,
+		}
+	}
+	return &ShadowsocksUDPRelayClient{
+		relayAddr: relayAddr,
+		pc:        newMuxedPacketConn(pc, shadowsocksCodec{cipher: d.cipher}),
+	}, nil
+}
+
+// ShadowsocksUDPRelayClient relays UDP packets through a single local
+// socket, so that the server maps all of them to the same endpoint.
+type ShadowsocksUDPRelayClient struct {
+	relayAddr net.Addr
+	pc        *muxedPacketConn
+	count     atomic.Int64
+	finalizer func()
+}
+
+func (r *ShadowsocksUDPRelayClient) Dial(address string) (net.Conn, error) {
+	addr, err := serializeAddr(address)
+	if err != nil {
+		return nil, &ShadowsocksError{
+			Net:  "udp",
+			Addr: address,
+			Err:  fmt.Errorf("failed to serialize address: %w", err),
+		}
+	}
+	r.Add(1)
+	return &udpConn{
+		muxedPacketConn: r.pc,
+		relayClient:     r,
+		relayAddr:       r.relayAddr,
+		targetAddr:      addr,
+	}, nil
+}
+
+func (r *ShadowsocksUDPRelayClient) Add(delta int64) {
+	if r.count.Add(delta) == 0 {
+		r.Close()
+	}
+}
+
+func (r *ShadowsocksUDPRelayClient) SetFinalizer(f func()) {
+	r.finalizer = f
+}
+
+func (r *ShadowsocksUDPRelayClient) Close() error {
+	if r.finalizer != nil {
+		r.finalizer()
+	}
+	return r.pc.Close()
+}
+
+type shadowsocksCodec struct {
+	cipher *shadowsocks.Cipher
+}
+
+func (c shadowsocksCodec) EncodePacket(target socks5.Addr, payload []byte) ([]byte, error) {
+	return c.cipher.EncodePacket(slices.Concat(target, payload))
+}
+
+func (c shadowsocksCodec) DecodePacket(packet []byte) (socks5.Addr, []byte, error) {
+	plaintext, err := c.cipher.DecodePacket(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := socks5.SplitAddr(plaintext)
+	if addr == nil {
+		return nil, nil, errors.New("invalid address in shadowsocks packet")
+	}
+	return addr, plaintext[len(addr):], nil
+}
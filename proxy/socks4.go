@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"proxy-ns/config"
+	"proxy-ns/proxy/transport/socks4"
+)
+
+type SOCKS4Client struct {
+	network string
+	address string
+	userID  string
+	forward Dialer
+
+	// resolveRemotely enables SOCKS4a, domain names are sent to the
+	// server instead of being rejected.
+	resolveRemotely bool
+}
+
+type SOCKS4Error struct {
+	// Cmd is the command which caused the error.
+	Cmd socks4.Command
+
+	// Addr is the network address for which this error occurred.
+	Addr string
+
+	// Err is the error that occurred during the operation.
+	// The Error method panics if the error is nil.
+	Err error
+}
+
+func (e *SOCKS4Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *SOCKS4Error) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	s := "socks4 " + e.Cmd.String()
+	if e.Addr != "" {
+		s += " " + e.Addr
+	}
+	s += ": " + e.Err.Error()
+	return s
+}
+
+// SOCKS4 returns a SOCKS4Client connecting to address through forward.
+// If forward is nil, Direct is used.
+func SOCKS4(network, address, userID string, forward Dialer) *SOCKS4Client {
+	if forward == nil {
+		forward = Direct
+	}
+	return &SOCKS4Client{
+		network: network,
+		address: address,
+		userID:  userID,
+		forward: forward,
+	}
+}
+
+// SOCKS4A is like SOCKS4, but domain names are resolved by the server.
+func SOCKS4A(network, address, userID string, forward Dialer) *SOCKS4Client {
+	c := SOCKS4(network, address, userID, forward)
+	c.resolveRemotely = true
+	return c
+}
+
+func (d *SOCKS4Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.Connect(ctx, address)
+	case "udp", "udp4", "udp6":
+		return nil, &SOCKS4Error{
+			Cmd:  socks4.CmdConnect,
+			Addr: address,
+			Err:  fmt.Errorf("network not supported by SOCKS4: %s", network),
+		}
+	default:
+		return nil, fmt.Errorf("network not implemented: %s", network)
+	}
+}
+
+// Probe checks whether the server accepts connections.
+func (d *SOCKS4Client) Probe(ctx context.Context) error {
+	return probeServer(ctx, d.forward, d.network, d.address)
+}
+
+func (d *SOCKS4Client) Connect(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, &SOCKS4Error{
+			Cmd:  socks4.CmdConnect,
+			Addr: address,
+			Err:  fmt.Errorf("invalid address: %w", err),
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil && !d.resolveRemotely {
+		return nil, &SOCKS4Error{
+			Cmd:  socks4.CmdConnect,
+			Addr: address,
+			Err:  errors.New("domain name is not supported by SOCKS4, use SOCKS4a instead"),
+		}
+	}
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
+	if err != nil {
+		return nil, &SOCKS4Error{
+			Cmd:  socks4.CmdConnect,
+			Addr: address,
+			Err:  fmt.Errorf("failed to connect to %s: %w", d.address, err),
+		}
+	}
+
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() error {
+		return socks4.ClientHandshake(conn, host, ip, port, socks4.CmdConnect, d.userID)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, &SOCKS4Error{
+			Cmd:  socks4.CmdConnect,
+			Addr: address,
+			Err:  fmt.Errorf("failed to perform client handshake: %w", err),
+		}
+	}
+	return conn, nil
+}
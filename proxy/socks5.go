@@ -6,14 +6,11 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"slices"
 	"strconv"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"proxy-ns/config"
-	"proxy-ns/network"
 	"proxy-ns/proxy/transport/socks5"
 )
 
@@ -21,6 +18,14 @@ type SOCKS5Client struct {
 	network string
 	address string
 	auth    *socks5.Auth
+	forward Dialer
+	pool    *connPool
+
+	pipeline  bool
+	earlyData bool
+	// noPipeline is set once a pipelined handshake fails, as the server
+	// may not support it.
+	noPipeline atomic.Bool
 }
 
 type SOCKS5Error struct {
@@ -52,7 +57,12 @@ func (e *SOCKS5Error) Error() string {
 	return s
 }
 
-func SOCKS5(network, address, username, password string) *SOCKS5Client {
+// SOCKS5 returns a SOCKS5Client connecting to address through forward.
+// If forward is nil, Direct is used.
+func SOCKS5(network, address, username, password string, forward Dialer) *SOCKS5Client {
+	if forward == nil {
+		forward = Direct
+	}
 	if username != "" && password != "" {
 		return &SOCKS5Client{
 			network: network,
@@ -61,21 +71,23 @@ func SOCKS5(network, address, username, password string) *SOCKS5Client {
 				Username: username,
 				Password: password,
 			},
+			forward: forward,
 		}
 	}
 	return &SOCKS5Client{
 		network: network,
 		address: address,
 		auth:    nil,
+		forward: forward,
 	}
 }
 
-func (d *SOCKS5Client) Dial(network, address string) (net.Conn, error) {
+func (d *SOCKS5Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
-		return d.Connect(address)
+		return d.Connect(ctx, address)
 	case "udp", "udp4", "udp6":
-		relay, err := d.UDPAssociate()
+		relay, err := d.UDPAssociate(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("failed to request udp associate: %w", err)
 		}
@@ -85,7 +97,57 @@ func (d *SOCKS5Client) Dial(network, address string) (net.Conn, error) {
 	}
 }
 
-func (d *SOCKS5Client) Connect(address string) (net.Conn, error) {
+// SetPool keeps authenticated connections to the server in advance,
+// which are used by Connect. It must be called before use.
+func (d *SOCKS5Client) SetPool(pool Pool) {
+	if pool.Size > 0 {
+		d.pool = newConnPool(d.authenticate, pool)
+	}
+}
+
+// SetPipeline enables the pipelined handshake, which sends the greeting,
+// the authentication and the request at once. If earlyData is true,
+// Connect returns before connecting, and the first write is sent along
+// with the handshake. It must be called before use.
+func (d *SOCKS5Client) SetPipeline(pipeline, earlyData bool) {
+	d.pipeline = pipeline
+	d.earlyData = earlyData
+}
+
+// authenticate connects to the server and authenticates.
+func (d *SOCKS5Client) authenticate() (net.Conn, error) {
+	ctx := context.Background()
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() error {
+		return socks5.ClientAuthenticate(conn, d.auth)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Probe connects to the server and authenticates.
+func (d *SOCKS5Client) Probe(ctx context.Context) error {
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", d.address, err)
+	}
+	defer conn.Close()
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() error {
+		return socks5.ClientAuthenticate(conn, d.auth)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to authenticate with %s: %w", d.address, err)
+	}
+	return nil
+}
+
+func (d *SOCKS5Client) Connect(ctx context.Context, address string) (net.Conn, error) {
 	addr, err := serializeAddr(address)
 	if err != nil {
 		return nil, &SOCKS5Error{
@@ -94,7 +156,49 @@ func (d *SOCKS5Client) Connect(address string) (net.Conn, error) {
 			Err:  fmt.Errorf("failed to serialize address: %w", err),
 		}
 	}
-	conn, err := net.Dial(d.network, d.address)
+	if d.pool != nil {
+		if conn := d.pool.Get(); conn != nil {
+			err := handshake(ctx, conn, config.HandshakeTimeout, func() error {
+				_, err := socks5.ClientRequest(conn, addr, socks5.CmdConnect)
+				return err
+			})
+			if err == nil {
+				return conn, nil
+			}
+			conn.Close()
+			// Retry with a new connection, unless the server
+			// replied with failure.
+			var rep socks5.Reply
+			if errors.As(err, &rep) {
+				return nil, &SOCKS5Error{
+					Cmd:  socks5.CmdConnect,
+					Addr: address,
+					Err:  fmt.Errorf("failed to perform client handshake: %w", err),
+				}
+			}
+		}
+	}
+
+	if d.earlyData {
+		// The connection is made after Connect returns, so it's
+		// not affected by ctx.
+		return newEarlyDataConn(func(payload []byte) (net.Conn, error) {
+			return d.connect(context.Background(), address, addr, payload)
+		}), nil
+	}
+	return d.connect(ctx, address, addr, nil)
+}
+
+// connectAddr connects to addr, which may be outside of the addresses
+// accepted by Connect, such as uot.MagicAddress with port 0.
+func (d *SOCKS5Client) connectAddr(ctx context.Context, addr socks5.Addr) (net.Conn, error) {
+	return d.connect(ctx, addr.String(), addr, nil)
+}
+
+// connect connects to address on a new connection, payload is sent along
+// with the handshake.
+func (d *SOCKS5Client) connect(ctx context.Context, address string, addr socks5.Addr, payload []byte) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
 	if err != nil {
 		return nil, &SOCKS5Error{
 			Cmd:  socks5.CmdConnect,
@@ -103,7 +207,39 @@ func (d *SOCKS5Client) Connect(address string) (net.Conn, error) {
 		}
 	}
 
-	_, err = socks5.ClientHandshake(conn, addr, socks5.CmdConnect, d.auth)
+	if d.pipeline && !d.noPipeline.Load() {
+		err = handshake(ctx, conn, config.HandshakeTimeout, func() error {
+			_, err := socks5.ClientHandshakePipelined(conn, addr, socks5.CmdConnect, d.auth, payload)
+			return err
+		})
+		if err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		// Fall back only if the server failed the pipelined
+		// negotiation, otherwise it may have processed the request
+		// and payload must not be sent again. The fallback is kept
+		// for the server, so that later connections don't wait for
+		// the timeout again.
+		if errors.Is(err, socks5.ErrNegotiation) {
+			log.Printf("socks5 %s: pipelined handshake failed, disabled: %s\n", d.address, err)
+			d.noPipeline.Store(true)
+			return d.connect(ctx, address, addr, payload)
+		}
+		return nil, &SOCKS5Error{
+			Cmd:  socks5.CmdConnect,
+			Addr: address,
+			Err:  fmt.Errorf("failed to perform client handshake: %w", err),
+		}
+	}
+
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() error {
+		_, err := socks5.ClientHandshake(conn, addr, socks5.CmdConnect, d.auth)
+		if err == nil && len(payload) > 0 {
+			_, err = conn.Write(payload)
+		}
+		return err
+	})
 	if err != nil {
 		conn.Close()
 		return nil, &SOCKS5Error{
@@ -115,8 +251,77 @@ func (d *SOCKS5Client) Connect(address string) (net.Conn, error) {
 	return conn, nil
 }
 
-func (d *SOCKS5Client) UDPAssociate() (*SOCKS5UDPRelayClient, error) {
-	conn, err := net.Dial(d.network, d.address)
+// Bind requests the server to accept an inbound connection from addr.
+// If the address is unknown, it should be all zeros.
+func (d *SOCKS5Client) Bind(ctx context.Context, addr socks5.Addr) (net.Listener, error) {
+	address := addr.String()
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
+	if err != nil {
+		return nil, &SOCKS5Error{
+			Cmd:  socks5.CmdBind,
+			Addr: address,
+			Err:  fmt.Errorf("failed to connect to %s: %w", d.address, err),
+		}
+	}
+
+	var boundAddr socks5.Addr
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() (err error) {
+		boundAddr, err = socks5.ClientHandshake(conn, addr, socks5.CmdBind, d.auth)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, &SOCKS5Error{
+			Cmd:  socks5.CmdBind,
+			Addr: address,
+			Err:  fmt.Errorf("failed to perform client handshake: %w", err),
+		}
+	}
+	return &socks5BindListener{
+		conn: conn,
+		addr: tcpAddr(boundAddr),
+	}, nil
+}
+
+// Resolve resolves host on the server, with the RESOLVE extension of Tor.
+func (d *SOCKS5Client) Resolve(ctx context.Context, host string) (net.IP, error) {
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
+	if err != nil {
+		return nil, &SOCKS5Error{
+			Cmd:  socks5.CmdResolve,
+			Addr: host,
+			Err:  fmt.Errorf("failed to connect to %s: %w", d.address, err),
+		}
+	}
+	defer conn.Close()
+
+	var addr socks5.Addr
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() (err error) {
+		addr, err = socks5.ClientHandshake(conn, socks5.SerializeAddr(host, nil, 0), socks5.CmdResolve, d.auth)
+		return err
+	})
+	if err != nil {
+		return nil, &SOCKS5Error{
+			Cmd:  socks5.CmdResolve,
+			Addr: host,
+			Err:  fmt.Errorf("failed to perform client handshake: %w", err),
+		}
+	}
+	resolved := addr.UDPAddr()
+	if resolved == nil {
+		return nil, &SOCKS5Error{
+			Cmd:  socks5.CmdResolve,
+			Addr: host,
+			Err:  fmt.Errorf("invalid resolved address: %#v", addr),
+		}
+	}
+	return resolved.IP, nil
+}
+
+func (d *SOCKS5Client) UDPAssociate(ctx context.Context) (UDPRelay, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.UDPAssociateTimeout)
+	defer cancel()
+	conn, err := d.forward.DialContext(ctx, d.network, d.address)
 	if err != nil {
 		return nil, &SOCKS5Error{
 			Cmd: socks5.CmdUDPAssociate,
@@ -134,7 +339,11 @@ func (d *SOCKS5Client) UDPAssociate() (*SOCKS5UDPRelayClient, error) {
 	// zeros. RFC1928
 	var targetAddr socks5.Addr = []byte{socks5.AtypIPv4, 0, 0, 0, 0, 0, 0}
 
-	addr, err := socks5.ClientHandshake(conn, targetAddr, socks5.CmdUDPAssociate, d.auth)
+	var addr socks5.Addr
+	err = handshake(ctx, conn, config.HandshakeTimeout, func() (err error) {
+		addr, err = socks5.ClientHandshake(conn, targetAddr, socks5.CmdUDPAssociate, d.auth)
+		return err
+	})
 	if err != nil {
 		conn.Close()
 		return nil, &SOCKS5Error{
@@ -145,23 +354,43 @@ func (d *SOCKS5Client) UDPAssociate() (*SOCKS5UDPRelayClient, error) {
 
 	relayAddr := addr.UDPAddr()
 	if relayAddr == nil {
+		conn.Close()
 		return nil, &SOCKS5Error{
 			Cmd: socks5.CmdUDPAssociate,
 			Err: fmt.Errorf("invalid UDP binding address: %#v", addr),
 		}
 	}
 
-	if relayAddr.IP.IsUnspecified() { /* e.g. "0.0.0.0" or "::" */
-		udpAddr, err := net.ResolveUDPAddr("udp", d.address)
+	relayAddrStr := relayAddr.String()
+	if relayAddr.IP.IsUnspecified() && d.network == "unix" {
+		// The server is on the same host, the relay is expected on
+		// the loopback address.
+		loopback := net.IPv6loopback
+		if relayAddr.IP.To4() != nil {
+			loopback = net.IPv4(127, 0, 0, 1)
+		}
+		relayAddrStr = net.JoinHostPort(loopback.String(), strconv.Itoa(relayAddr.Port))
+	} else if relayAddr.IP.IsUnspecified() { /* e.g. "0.0.0.0" or "::" */
+		host, _, err := net.SplitHostPort(d.address)
 		if err != nil {
+			conn.Close()
 			return nil, &SOCKS5Error{
 				Cmd: socks5.CmdUDPAssociate,
-				Err: fmt.Errorf("resolve udp address %s: %w", d.address, err),
+				Err: fmt.Errorf("invalid server address %s: %w", d.address, err),
 			}
 		}
-		relayAddr.IP = udpAddr.IP
+		relayAddrStr = net.JoinHostPort(host, strconv.Itoa(relayAddr.Port))
 	}
-	return NewSOCKS5UDPRelayClient(conn, relayAddr)
+
+	pc, udpRelayAddr, err := listenRelay(ctx, d.forward, relayAddrStr)
+	if err != nil {
+		conn.Close()
+		return nil, &SOCKS5Error{
+			Cmd: socks5.CmdUDPAssociate,
+			Err: err,
+		}
+	}
+	return NewSOCKS5UDPRelayClient(conn, pc, udpRelayAddr), nil
 }
 
 func serializeAddr(address string) (socks5.Addr, error) {
@@ -199,19 +428,12 @@ type SOCKS5UDPRelayClient struct {
 	finalizer func()
 }
 
-func NewSOCKS5UDPRelayClient(tcpConn net.Conn, relayAddr net.Addr) (*SOCKS5UDPRelayClient, error) {
-	pc, err := net.ListenPacket("udp", "0.0.0.0:0")
-	if err != nil {
-		return nil, &SOCKS5Error{
-			Cmd: socks5.CmdUDPAssociate,
-			Err: err,
-		}
-	}
+func NewSOCKS5UDPRelayClient(tcpConn net.Conn, pc net.PacketConn, relayAddr net.Addr) *SOCKS5UDPRelayClient {
 	return &SOCKS5UDPRelayClient{
 		tcpConn:   tcpConn,
 		relayAddr: relayAddr,
-		pc:        newMuxedPacketConn(pc),
-	}, nil
+		pc:        newMuxedPacketConn(pc, socks5Codec{}),
+	}
 }
 
 func (r *SOCKS5UDPRelayClient) Dial(address string) (net.Conn, error) {
@@ -224,7 +446,7 @@ func (r *SOCKS5UDPRelayClient) Dial(address string) (net.Conn, error) {
 		}
 	}
 	r.Add(1)
-	return &socks5UDPConn{
+	return &udpConn{
 		muxedPacketConn: r.pc,
 		relayClient:     r,
 		relayAddr:       r.relayAddr,
@@ -251,150 +473,82 @@ func (r *SOCKS5UDPRelayClient) Close() error {
 	return r.pc.Close()
 }
 
-func newMuxedPacketConn(pc net.PacketConn) *muxedPacketConn {
-	return &muxedPacketConn{PacketConn: pc}
+// socks5BindListener waits for the second reply of BIND.
+type socks5BindListener struct {
+	conn      net.Conn
+	addr      net.Addr
+	mutex     sync.Mutex
+	accepting bool
+	accepted  bool
+	closed    bool
 }
 
-type muxedPacketConn struct {
-	net.PacketConn
-	once    sync.Once
-	packets sync.Map // map[endpoint]chan []byte
-}
-
-type endpoint struct {
-	relayAddr  string
-	targetAddr string
-}
-
-func newSocketBuffer(timeout time.Duration) *socketBuffer {
-	s := &socketBuffer{
-		timeout: timeout,
-	}
-	s.notifyCh.Store(make(chan struct{}))
-	return s
-}
-
-type socketBuffer struct {
-	packets  [][]byte
-	mutex    sync.Mutex
-	notifyCh atomic.Value // chan struct{}
-	timeout  time.Duration
-}
-
-func (s *socketBuffer) Notify() {
-	old := s.notifyCh.Swap(make(chan struct{}))
-	close(old.(chan struct{}))
-}
-
-func (s *socketBuffer) Write(p []byte) (n int, err error) {
-	if len(p) == 0 {
-		return 0, nil
+func (l *socks5BindListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	if l.accepting || l.closed {
+		l.mutex.Unlock()
+		return nil, net.ErrClosed
 	}
-	s.mutex.Lock()
-	s.packets = append(s.packets, slices.Clone(p))
-	s.mutex.Unlock()
+	l.accepting = true
+	l.mutex.Unlock()
 
-	s.Notify()
-	return len(p), nil
-}
+	peerAddr, err := socks5.ReadReply(l.conn)
 
-func (s *socketBuffer) Read(p []byte) (n int, err error) {
-	if len(p) == 0 {
-		return 0, nil
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil, net.ErrClosed
 	}
-	for {
-		s.mutex.Lock()
-		if len(s.packets) == 0 {
-			s.mutex.Unlock()
-			select {
-			case <-s.notifyCh.Load().(chan struct{}):
-				continue
-			case <-time.After(s.timeout):
-				return 0, context.DeadlineExceeded
-			}
-		}
-		packet := s.packets[0]
-		if len(p) >= len(packet) {
-			s.packets = s.packets[1:]
-		} else {
-			s.packets[0] = s.packets[0][len(p):]
+	if err != nil {
+		l.closed = true
+		l.conn.Close()
+		return nil, &SOCKS5Error{
+			Cmd: socks5.CmdBind,
+			Err: fmt.Errorf("failed to accept inbound connection: %w", err),
 		}
-		s.mutex.Unlock()
-		return copy(p, packet), nil
 	}
+	l.accepted = true
+	return &bindConn{Conn: l.conn, remoteAddr: tcpAddr(peerAddr)}, nil
 }
 
-func (c *muxedPacketConn) poll() {
-	buf := make([]byte, network.MaxPacketSize)
-	for {
-		n, addr, err := c.PacketConn.ReadFrom(buf)
-		if err != nil {
-			return
-		}
-		target, payload, err := socks5.DecodeUDPPacket(buf[:n])
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		ep := endpoint{
-			relayAddr:  addr.String(),
-			targetAddr: target.String(),
-		}
-		value, ok := c.packets.Load(ep)
-		if ok {
-			value.(*socketBuffer).Write(payload)
-		} else {
-			// gvisor's udp.NewForwarder cannot handle unrelated packet.
-			log.Println("Failed to associate packet from:", ep.targetAddr)
-		}
+// Close aborts pending Accept. The accepted connection is not closed.
+func (l *socks5BindListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed || l.accepted {
+		return nil
 	}
+	l.closed = true
+	return l.conn.Close()
 }
 
-func (c *muxedPacketConn) ReadFrom(p []byte, relayAddr net.Addr, target socks5.Addr) (n int, err error) {
-	ep := endpoint{
-		relayAddr:  relayAddr.String(),
-		targetAddr: target.String(),
-	}
-	actual, _ := c.packets.LoadOrStore(ep, newSocketBuffer(config.UDPSessionTimeout))
-	go c.once.Do(c.poll)
-	return actual.(*socketBuffer).Read(p)
+func (l *socks5BindListener) Addr() net.Addr {
+	return l.addr
 }
 
-func (c *muxedPacketConn) WriteTo(p []byte, relayAddr net.Addr, target socks5.Addr) (n int, err error) {
-	data, err := socks5.EncodeUDPPacket(target, p)
-	if err != nil {
-		return 0, err
-	}
-	n, err = c.PacketConn.WriteTo(data, relayAddr)
-	if err != nil {
-		return 0, err
-	}
-	if n < len(data) {
-		return 0, fmt.Errorf("short write: expected %d, not %d", len(data), n)
-	}
-	return len(p), nil
+type bindConn struct {
+	net.Conn
+	remoteAddr net.Addr
 }
 
-type socks5UDPConn struct {
-	*muxedPacketConn
-	relayClient *SOCKS5UDPRelayClient
-	relayAddr   net.Addr
-	targetAddr  socks5.Addr
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
 }
 
-func (c *socks5UDPConn) Read(p []byte) (n int, err error) {
-	return c.muxedPacketConn.ReadFrom(p, c.relayAddr, c.targetAddr)
+// tcpAddr converts a to *net.TCPAddr if possible.
+func tcpAddr(a socks5.Addr) net.Addr {
+	if udpAddr := a.UDPAddr(); udpAddr != nil {
+		return &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port}
+	}
+	return &stringAddr{network: "tcp", address: a.String()}
 }
 
-func (c *socks5UDPConn) Write(p []byte) (n int, err error) {
-	return c.muxedPacketConn.WriteTo(p, c.relayAddr, c.targetAddr)
-}
+type socks5Codec struct{}
 
-func (c *socks5UDPConn) RemoteAddr() net.Addr {
-	return c.targetAddr.UDPAddr()
+func (socks5Codec) EncodePacket(target socks5.Addr, payload []byte) ([]byte, error) {
+	return socks5.EncodeUDPPacket(target, payload)
 }
 
-func (c *socks5UDPConn) Close() error {
-	c.relayClient.Add(-1)
-	return nil
+func (socks5Codec) DecodePacket(packet []byte) (socks5.Addr, []byte, error) {
+	return socks5.DecodeUDPPacket(packet)
 }
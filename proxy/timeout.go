@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a non-zero time in the past, which interrupts blocked
+// I/O when set as deadline.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// handshake runs f, which performs the handshake on conn. The I/O on
+// conn is interrupted after timeout, or when ctx is done.
+func handshake(ctx context.Context, conn net.Conn, timeout time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	err := f()
+	if !stop() {
+		return ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"proxy-ns/config"
+)
+
+// TLSDialer wraps connections to the proxy server with TLS.
+type TLSDialer struct {
+	forward Dialer
+	config  *tls.Config
+}
+
+type TLSError struct {
+	// Addr is the address of the proxy server.
+	Addr string
+
+	// Err is the error that occurred during the handshake.
+	// The Error method panics if the error is nil.
+	Err error
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TLSError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return "tls handshake with " + e.Addr + " failed: " + e.Err.Error()
+}
+
+// TLS returns a TLSDialer connecting through forward. If forward is
+// nil, Direct is used. If config.ServerName is empty, the host of the
+// dialed address is used.
+func TLS(forward Dialer, config *tls.Config) *TLSDialer {
+	if forward == nil {
+		forward = Direct
+	}
+	return &TLSDialer{
+		forward: forward,
+		config:  config,
+	}
+}
+
+func (d *TLSDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := d.config
+	if tlsConfig.ServerName == "" {
+		if network == "unix" {
+			conn.Close()
+			return nil, &TLSError{Addr: address, Err: errors.New("server name must be specified for unix socket")}
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, &TLSError{Addr: address, Err: err}
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = handshake(ctx, conn, config.HandshakeTimeout, tlsConn.Handshake)
+	if err != nil {
+		conn.Close()
+		return nil, &TLSError{Addr: address, Err: err}
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,193 @@
+// Package http provides HTTP CONNECT client functionalities.
+package http
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"strings"
+
+	"proxy-ns/proxy/transport/ntlm"
+)
+
+// Scheme is the proxy authentication scheme as defined in RFC 9110 section 11.
+type Scheme uint8
+
+const (
+	SchemeNone Scheme = iota
+	SchemeBasic
+	SchemeNTLM
+	SchemeNegotiate
+)
+
+func (s Scheme) String() string {
+	switch s {
+	case SchemeNone:
+		return "None"
+	case SchemeBasic:
+		return "Basic"
+	case SchemeNTLM:
+		return "NTLM"
+	case SchemeNegotiate:
+		return "Negotiate"
+	default:
+		return "undefined"
+	}
+}
+
+// Auth provides HTTP proxy auth functionality.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// RetryError is returned when the proxy closes the connection while
+// asking for authentication. The handshake should be retried on a new
+// connection with Scheme.
+type RetryError struct {
+	Scheme Scheme
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("proxy closed connection, retry with %s authentication", e.Scheme)
+}
+
+// StatusError is returned when the proxy doesn't accept the CONNECT request.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "proxy responded with " + e.Status
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// ClientHandshake sends CONNECT request for target on conn. It
+// authenticates using scheme first, and switches to the scheme offered
+// by the proxy if it is rejected.
+//
+// The returned net.Conn should be used in place of conn, as the proxy
+// may have sent data following the response. The returned Scheme is the
+// one accepted by the proxy.
+func ClientHandshake(conn net.Conn, target string, auth *Auth, scheme Scheme) (net.Conn, Scheme, error) {
+	if auth == nil {
+		scheme = SchemeNone
+	}
+	br := bufio.NewReader(conn)
+
+	var (
+		user, domain string
+		challenge    []byte
+	)
+	if auth != nil {
+		user, domain = ntlm.SplitUsername(auth.Username)
+	}
+	for {
+		var credentials string
+		switch scheme {
+		case SchemeBasic:
+			credentials = "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password))
+		case SchemeNTLM, SchemeNegotiate:
+			token := ntlm.NegotiateMessage()
+			if challenge != nil {
+				var err error
+				token, err = ntlm.AuthenticateMessage(challenge, user, domain, auth.Password)
+				if err != nil {
+					return nil, scheme, err
+				}
+			}
+			credentials = scheme.String() + " " + base64.StdEncoding.EncodeToString(token)
+		}
+
+		req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+		if credentials != "" {
+			req += "Proxy-Authorization: " + credentials + "\r\n"
+		}
+		req += "\r\n"
+		if _, err := io.WriteString(conn, req); err != nil {
+			return nil, scheme, err
+		}
+
+		resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: nethttp.MethodConnect})
+		if err != nil {
+			return nil, scheme, err
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			if br.Buffered() > 0 {
+				return &bufferedConn{Conn: conn, r: br}, scheme, nil
+			}
+			return conn, scheme, nil
+		}
+
+		// Drain the body, so that the connection can be reused for
+		// the next round of authentication.
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, scheme, err
+		}
+
+		if resp.StatusCode != nethttp.StatusProxyAuthRequired || auth == nil {
+			return nil, scheme, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+
+		offered, token := parseChallenge(resp.Header.Values("Proxy-Authenticate"))
+		switch {
+		case (scheme == SchemeNTLM || scheme == SchemeNegotiate) && challenge == nil && token != nil:
+			challenge = token
+		case scheme == SchemeNone && offered != SchemeNone:
+			scheme = offered
+			challenge = nil
+		default:
+			return nil, scheme, errors.New("proxy rejected credentials")
+		}
+		if resp.Close {
+			if challenge != nil {
+				// NTLM authenticates the connection, not the request.
+				return nil, scheme, errors.New("proxy closed connection during NTLM handshake")
+			}
+			return nil, scheme, &RetryError{Scheme: scheme}
+		}
+	}
+}
+
+// parseChallenge returns the strongest supported scheme offered in
+// Proxy-Authenticate headers, along with the NTLM challenge if any.
+func parseChallenge(headers []string) (scheme Scheme, token []byte) {
+	for _, header := range headers {
+		name, param, _ := strings.Cut(strings.TrimSpace(header), " ")
+		var s Scheme
+		switch strings.ToLower(name) {
+		case "basic":
+			s = SchemeBasic
+		case "ntlm":
+			s = SchemeNTLM
+		case "negotiate":
+			s = SchemeNegotiate
+		default:
+			continue
+		}
+		if s == SchemeNTLM || s == SchemeNegotiate {
+			if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(param)); err == nil && len(b) > 0 {
+				token = b
+			}
+		}
+		if s > scheme {
+			scheme = s
+		}
+	}
+	return scheme, token
+}
@@ -0,0 +1,197 @@
+// Package ntlm provides client side NTLMv2 message construction as defined in MS-NLMP.
+package ntlm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+var signature = []byte("NTLMSSP\x00")
+
+// Message types as defined in MS-NLMP section 2.2.1.
+const (
+	typeNegotiate    uint32 = 0x01
+	typeChallenge    uint32 = 0x02
+	typeAuthenticate uint32 = 0x03
+)
+
+// Negotiate flags as defined in MS-NLMP section 2.2.2.5.
+const (
+	flagUnicode                 uint32 = 0x00000001
+	flagRequestTarget           uint32 = 0x00000004
+	flagNTLM                    uint32 = 0x00000200
+	flagAlwaysSign              uint32 = 0x00008000
+	flagExtendedSessionSecurity uint32 = 0x00080000
+	flagTargetInfo              uint32 = 0x00800000
+	flag128                     uint32 = 0x20000000
+	flag56                      uint32 = 0x80000000
+
+	defaultFlags = flagUnicode | flagRequestTarget | flagNTLM | flagAlwaysSign | flagExtendedSessionSecurity | flagTargetInfo | flag128 | flag56
+)
+
+// AV_PAIR ids as defined in MS-NLMP section 2.2.2.1.
+const (
+	avIDMsvAvEOL       uint16 = 0x0000
+	avIDMsvAvTimestamp uint16 = 0x0007
+)
+
+// authenticateMessageHeaderLen is the length of AUTHENTICATE_MESSAGE
+// without Version and MIC fields.
+const authenticateMessageHeaderLen = 64
+
+// SplitUsername splits "DOMAIN\user" and "user@DOMAIN" into user and domain.
+func SplitUsername(username string) (user, domain string) {
+	if before, after, ok := strings.Cut(username, `\`); ok {
+		return after, before
+	}
+	if before, after, ok := strings.Cut(username, "@"); ok {
+		return before, after
+	}
+	return username, ""
+}
+
+// NegotiateMessage returns the NEGOTIATE_MESSAGE which starts the handshake.
+func NegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, signature)
+	binary.LittleEndian.PutUint32(msg[8:], typeNegotiate)
+	binary.LittleEndian.PutUint32(msg[12:], defaultFlags)
+	// DomainNameFields and WorkstationFields are left empty.
+	return msg
+}
+
+type challenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetInfo      []byte
+}
+
+func parseChallenge(msg []byte) (*challenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], signature) {
+		return nil, errors.New("invalid NTLM challenge message")
+	}
+	if binary.LittleEndian.Uint32(msg[8:]) != typeChallenge {
+		return nil, errors.New("unexpected NTLM message type")
+	}
+	c := &challenge{
+		flags:           binary.LittleEndian.Uint32(msg[20:]),
+		serverChallenge: msg[24:32],
+	}
+	if len(msg) >= 48 {
+		length := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+length > len(msg) {
+			return nil, errors.New("invalid NTLM target info")
+		}
+		c.targetInfo = msg[offset : offset+length]
+	}
+	return c, nil
+}
+
+// timestamp returns MsvAvTimestamp of target info, if any.
+func (c *challenge) timestamp() []byte {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == avIDMsvAvEOL || len(info) < 4+length {
+			break
+		}
+		if id == avIDMsvAvTimestamp && length == 8 {
+			return info[4 : 4+length]
+		}
+		info = info[4+length:]
+	}
+	return nil
+}
+
+// AuthenticateMessage returns the AUTHENTICATE_MESSAGE answering the
+// CHALLENGE_MESSAGE challengeMsg, using NTLMv2 responses.
+func AuthenticateMessage(challengeMsg []byte, user, domain, password string) ([]byte, error) {
+	c, err := parseChallenge(challengeMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	h := md4.New()
+	h.Write(encodeUTF16(password))
+	responseKey := hmacMD5(h.Sum(nil), encodeUTF16(strings.ToUpper(user)+domain))
+
+	// If NTLM v2 authentication is used and the CHALLENGE_MESSAGE
+	// TargetInfo field has an MsvAvTimestamp present, the client SHOULD
+	// NOT send the LmChallengeResponse. MS-NLMP 3.1.5.1.2
+	// It's sent as an empty field then.
+	timestamp := c.timestamp()
+	var lmResponse []byte
+	if timestamp == nil {
+		// 100-nanosecond intervals since January 1, 1601
+		timestamp = binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()/100+116444736000000000))
+		lmResponse = append(hmacMD5(responseKey, c.serverChallenge, clientChallenge), clientChallenge...)
+	}
+
+	temp := &bytes.Buffer{}
+	temp.Write([]byte{0x01 /* RespType */, 0x01 /* HiRespType */, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(c.targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+	ntProof := hmacMD5(responseKey, c.serverChallenge, temp.Bytes())
+	ntResponse := append(ntProof, temp.Bytes()...)
+
+	flags := defaultFlags & c.flags
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		encodeUTF16(domain),
+		encodeUTF16(user),
+		nil, /* Workstation */
+		nil, /* EncryptedRandomSessionKey */
+	}
+
+	msg := make([]byte, authenticateMessageHeaderLen)
+	copy(msg, signature)
+	binary.LittleEndian.PutUint32(msg[8:], typeAuthenticate)
+	offset := authenticateMessageHeaderLen
+	for i, field := range fields {
+		binary.LittleEndian.PutUint16(msg[12+i*8:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[14+i*8:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[16+i*8:], uint32(offset))
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	for _, field := range fields {
+		msg = append(msg, field...)
+	}
+	return msg, nil
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func encodeUTF16(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, r)
+	}
+	return b
+}
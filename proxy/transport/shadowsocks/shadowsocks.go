@@ -0,0 +1,228 @@
+// Package shadowsocks provides Shadowsocks AEAD client functionalities.
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MaxPayloadSize is the maximum size of payload in a TCP chunk as
+// defined in the Shadowsocks AEAD specification.
+const MaxPayloadSize = 0x3FFF
+
+// Overhead is the size of AEAD tag.
+const Overhead = 16
+
+var subkeyInfo = []byte("ss-subkey")
+
+var ErrShortPacket = errors.New("short packet")
+
+// Cipher holds the master key of AEAD ciphers.
+type Cipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewCipher derives the master key from password for method.
+func NewCipher(method, password string) (*Cipher, error) {
+	var (
+		keySize int
+		newAEAD func(key []byte) (cipher.AEAD, error)
+	)
+	switch method {
+	case "chacha20-ietf-poly1305":
+		keySize, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	case "aes-256-gcm":
+		keySize, newAEAD = 32, newGCM
+	case "aes-128-gcm":
+		keySize, newAEAD = 16, newGCM
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %s", method)
+	}
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+	return &Cipher{
+		key:     kdf(password, keySize),
+		newAEAD: newAEAD,
+	}, nil
+}
+
+// kdf is EVP_BytesToKey with MD5 and no salt, as used by Shadowsocks.
+func kdf(password string, keySize int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		b = h.Sum(b)
+		prev = b[len(b)-h.Size():]
+	}
+	return b[:keySize]
+}
+
+// SaltSize is the same as the key size.
+func (c *Cipher) SaltSize() int {
+	return len(c.key)
+}
+
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, subkeyInfo), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// EncodePacket encrypts a UDP packet: [salt][encrypted payload][tag].
+func (c *Cipher) EncodePacket(payload []byte) ([]byte, error) {
+	salt := make([]byte, c.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), payload, nil), nil
+}
+
+// DecodePacket decrypts a UDP packet, and this function is mutable with `packet`.
+func (c *Cipher) DecodePacket(packet []byte) ([]byte, error) {
+	saltSize := c.SaltSize()
+	if len(packet) < saltSize+Overhead {
+		return nil, ErrShortPacket
+	}
+	aead, err := c.aead(packet[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(packet[saltSize:saltSize], make([]byte, aead.NonceSize()), packet[saltSize:], nil)
+}
+
+// StreamConn wraps conn with Shadowsocks AEAD stream encryption.
+func (c *Cipher) StreamConn(conn net.Conn) net.Conn {
+	return &streamConn{Conn: conn, cipher: c}
+}
+
+type streamConn struct {
+	net.Conn
+	cipher *Cipher
+
+	writer cipher.AEAD
+	wnonce []byte
+	wbuf   []byte
+
+	reader cipher.AEAD
+	rnonce []byte
+	rbuf   []byte
+	// leftover is decrypted payload not yet read.
+	leftover []byte
+}
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *streamConn) Write(p []byte) (n int, err error) {
+	if c.writer == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		c.writer, err = c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.wnonce = make([]byte, c.writer.NonceSize())
+		c.wbuf = append(make([]byte, 0, len(salt)+2+Overhead+MaxPayloadSize+Overhead), salt...)
+	}
+
+	for len(p) > 0 {
+		chunk := p[:min(len(p), MaxPayloadSize)]
+
+		// [encrypted payload length][length tag][encrypted payload][payload tag]
+		c.wbuf = c.writer.Seal(c.wbuf, c.wnonce, binary.BigEndian.AppendUint16(nil, uint16(len(chunk))), nil)
+		increment(c.wnonce)
+		c.wbuf = c.writer.Seal(c.wbuf, c.wnonce, chunk, nil)
+		increment(c.wnonce)
+
+		if _, err := c.Conn.Write(c.wbuf); err != nil {
+			return n, err
+		}
+		c.wbuf = c.wbuf[:0]
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *streamConn) Read(p []byte) (n int, err error) {
+	if len(c.leftover) > 0 {
+		n = copy(p, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+
+	if c.reader == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		c.reader, err = c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.rnonce = make([]byte, c.reader.NonceSize())
+		c.rbuf = make([]byte, MaxPayloadSize+Overhead)
+	}
+
+	buf := c.rbuf[:2+Overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	if _, err := c.reader.Open(buf[:0], c.rnonce, buf, nil); err != nil {
+		return 0, err
+	}
+	increment(c.rnonce)
+	size := int(binary.BigEndian.Uint16(buf) & MaxPayloadSize)
+
+	buf = c.rbuf[:size+Overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	payload, err := c.reader.Open(buf[:0], c.rnonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increment(c.rnonce)
+
+	n = copy(p, payload)
+	c.leftover = payload[n:]
+	return n, nil
+}
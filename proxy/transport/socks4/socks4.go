@@ -0,0 +1,103 @@
+// Package socks4 provides SOCKS4 and SOCKS4a client functionalities.
+package socks4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Version is the protocol version of SOCKS4.
+const Version = 0x04
+
+// Command is request commands of SOCKS4.
+type Command uint8
+
+// SOCKS4 request commands.
+const (
+	CmdConnect Command = 0x01
+	CmdBind    Command = 0x02
+)
+
+func (c Command) String() string {
+	switch c {
+	case CmdConnect:
+		return "connect"
+	case CmdBind:
+		return "bind"
+	default:
+		return "undefined"
+	}
+}
+
+// Reply is the CD field of SOCKS4 reply.
+type Reply uint8
+
+const ReplyGranted Reply = 90
+
+func (r Reply) String() string {
+	switch r {
+	case 90:
+		return "request granted"
+	case 91:
+		return "request rejected or failed"
+	case 92:
+		return "request rejected because SOCKS server cannot connect to identd on the client"
+	case 93:
+		return "request rejected because the client program and identd report different user-ids"
+	default:
+		return fmt.Sprintf("unassigned <%#02x>", uint8(r))
+	}
+}
+
+// ClientHandshake sends command request for host:port.
+//
+// If ip is nil, host is sent as SOCKS4a domain name. Otherwise ip must
+// be an IPv4 address.
+func ClientHandshake(rw io.ReadWriter, host string, ip net.IP, port uint16, command Command, userID string) error {
+	var dstIP net.IP
+	if ip == nil {
+		if host == "" {
+			return errors.New("empty host")
+		}
+		// SOCKS4a: DSTIP is set to 0.0.0.x with x nonzero, and the
+		// domain name follows the USERID.
+		dstIP = net.IPv4(0, 0, 0, 1).To4()
+	} else {
+		dstIP = ip.To4()
+		if dstIP == nil {
+			return errors.New("IPv6 address is not supported")
+		}
+	}
+
+	// VN, CD, DSTPORT, DSTIP, USERID, NULL
+	req := &bytes.Buffer{}
+	req.Write([]byte{Version, byte(command)})
+	req.Write(binary.BigEndian.AppendUint16(nil, port))
+	req.Write(dstIP)
+	req.WriteString(userID)
+	req.WriteByte(0x00)
+	if ip == nil {
+		req.WriteString(host)
+		req.WriteByte(0x00)
+	}
+	if _, err := rw.Write(req.Bytes()); err != nil {
+		return err
+	}
+
+	// VN, CD, DSTPORT, DSTIP
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0x00 {
+		return errors.New("invalid reply version")
+	}
+	if rep := Reply(buf[1]); rep != ReplyGranted {
+		return errors.New(rep.String())
+	}
+	return nil
+}
@@ -22,6 +22,10 @@ const (
 	CmdConnect      Command = 0x01
 	CmdBind         Command = 0x02
 	CmdUDPAssociate Command = 0x03
+
+	// CmdResolve is the RESOLVE extension of Tor, which replies with
+	// the resolved address of the requested domain name.
+	CmdResolve Command = 0xF0
 )
 
 func (c Command) String() string {
@@ -32,6 +36,8 @@ func (c Command) String() string {
 		return "bind"
 	case CmdUDPAssociate:
 		return "udp-associate"
+	case CmdResolve:
+		return "resolve"
 	default:
 		return "undefined"
 	}
@@ -74,6 +80,12 @@ func (r Reply) String() string {
 	}
 }
 
+// Error implements error, a Reply other than succeeded is returned as
+// error by ReadReply.
+func (r Reply) Error() string {
+	return r.String()
+}
+
 // MaxAddrLen is the maximum size of SOCKS address in bytes.
 const MaxAddrLen = 1 + 1 + 255 + 2
 
@@ -158,7 +170,15 @@ type Auth struct {
 
 // ClientHandshake fast-tracks SOCKS initialization to get target address to connect on client side.
 func ClientHandshake(rw io.ReadWriter, addr Addr, command Command, auth *Auth) (Addr, error) {
-	buf := make([]byte, MaxAddrLen)
+	if err := ClientAuthenticate(rw, auth); err != nil {
+		return nil, err
+	}
+	return ClientRequest(rw, addr, command)
+}
+
+// ClientAuthenticate negotiates authentication method, and authenticates with auth if required.
+func ClientAuthenticate(rw io.ReadWriter, auth *Auth) error {
+	buf := make([]byte, 2)
 
 	var method uint8
 	if auth != nil {
@@ -169,66 +189,163 @@ func ClientHandshake(rw io.ReadWriter, addr Addr, command Command, auth *Auth) (
 
 	// VER, NMETHODS, METHODS
 	if _, err := rw.Write([]byte{Version, 0x01 /* NMETHODS */, method}); err != nil {
-		return nil, err
+		return err
 	}
 
 	// VER, METHOD
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return nil, err
+		return err
 	}
 
 	if buf[0] != Version {
-		return nil, errors.New("socks version mismatched")
+		return errors.New("socks version mismatched")
 	}
 
 	if buf[1] == 0x02 /* USERNAME/PASSWORD */ {
 		if auth == nil {
-			return nil, errors.New("auth required")
+			return errors.New("auth required")
 		}
 
-		// password protocol version
-		authMsg := &bytes.Buffer{}
-		authMsg.WriteByte(0x01 /* VER */)
-		authMsg.WriteByte(byte(len(auth.Username)) /* ULEN */)
-		authMsg.WriteString(auth.Username /* UNAME */)
-		authMsg.WriteByte(byte(len(auth.Password)) /* PLEN */)
-		authMsg.WriteString(auth.Password /* PASSWD */)
-
-		if len(authMsg.Bytes()) > MaxAuthLen {
-			return nil, errors.New("auth message too long")
+		authMsg, err := authMessage(auth)
+		if err != nil {
+			return err
 		}
 
-		if _, err := rw.Write(authMsg.Bytes()); err != nil {
-			return nil, err
+		if _, err := rw.Write(authMsg); err != nil {
+			return err
 		}
 
 		if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-			return nil, err
+			return err
 		}
 
 		if buf[1] != 0x00 /* STATUS of SUCCESS */ {
-			return nil, errors.New("rejected username/password")
+			return errors.New("rejected username/password")
 		}
 
 	} else if buf[1] != 0x00 /* NO AUTHENTICATION REQUIRED */ {
-		return nil, errors.New("unsupported method")
+		return errors.New("unsupported method")
+	}
+	return nil
+}
+
+func authMessage(auth *Auth) ([]byte, error) {
+	// password protocol version
+	authMsg := &bytes.Buffer{}
+	authMsg.WriteByte(0x01 /* VER */)
+	authMsg.WriteByte(byte(len(auth.Username)) /* ULEN */)
+	authMsg.WriteString(auth.Username /* UNAME */)
+	authMsg.WriteByte(byte(len(auth.Password)) /* PLEN */)
+	authMsg.WriteString(auth.Password /* PASSWD */)
+
+	if len(authMsg.Bytes()) > MaxAuthLen {
+		return nil, errors.New("auth message too long")
+	}
+	return authMsg.Bytes(), nil
+}
+
+// ErrNegotiation is wrapped by errors of ClientHandshakePipelined when
+// the server rejects the method or the authentication, or closes or
+// stops responding before replying to the request. Servers which discard
+// the messages following the greeting fail this way, and the request
+// isn't processed.
+var ErrNegotiation = errors.New("negotiation failed")
+
+// negotiationError wraps err with ErrNegotiation if the server closed
+// the connection or stopped responding.
+func negotiationError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrNegotiation, err)
+	}
+	return err
+}
+
+// ClientHandshakePipelined is like ClientHandshake, but it sends the
+// greeting, the authentication and the request at once, followed by
+// payload, before reading any reply. It requires the server to select
+// the offered method, and to read each message without discarding the
+// following ones.
+func ClientHandshakePipelined(rw io.ReadWriter, addr Addr, command Command, auth *Auth, payload []byte) (Addr, error) {
+	buf := make([]byte, 2)
+
+	var method uint8
+	if auth != nil {
+		method = 0x02 /* USERNAME/PASSWORD */
+	} else {
+		method = 0x00 /* NO AUTHENTICATION REQUIRED */
+	}
+
+	// VER, NMETHODS, METHODS
+	msg := []byte{Version, 0x01 /* NMETHODS */, method}
+	if auth != nil {
+		authMsg, err := authMessage(auth)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, authMsg...)
+	}
+	// VER, CMD, RSV, ADDR
+	msg = append(msg, Version, byte(command), 0x00 /* RSV */)
+	msg = append(msg, addr...)
+	msg = append(msg, payload...)
+	if _, err := rw.Write(msg); err != nil {
+		return nil, err
+	}
+
+	// VER, METHOD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return nil, negotiationError(err)
+	}
+	if buf[0] != Version {
+		return nil, fmt.Errorf("%w: socks version mismatched", ErrNegotiation)
+	}
+	if buf[1] != method {
+		return nil, fmt.Errorf("%w: unsupported method", ErrNegotiation)
 	}
 
+	if auth != nil {
+		if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+			return nil, negotiationError(err)
+		}
+		if buf[1] != 0x00 /* STATUS of SUCCESS */ {
+			return nil, fmt.Errorf("%w: rejected username/password", ErrNegotiation)
+		}
+	}
+
+	bound, err := ReadReply(rw)
+	if err != nil {
+		return nil, negotiationError(err)
+	}
+	return bound, nil
+}
+
+// ClientRequest sends command request on an authenticated connection, and returns the bound address.
+func ClientRequest(rw io.ReadWriter, addr Addr, command Command) (Addr, error) {
 	// VER, CMD, RSV, ADDR
 	if _, err := rw.Write(bytes.Join([][]byte{{Version, byte(command), 0x00 /* RSV */}, addr}, nil)); err != nil {
 		return nil, err
 	}
 
+	return ReadReply(rw)
+}
+
+// ReadReply reads a reply, and returns the bound address. For BIND, it's
+// also used to read the second reply, which returns the address of the
+// connecting host.
+func ReadReply(r io.Reader) (Addr, error) {
+	buf := make([]byte, MaxAddrLen)
+
 	// VER, REP, RSV
-	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
+	if _, err := io.ReadFull(r, buf[:3]); err != nil {
 		return nil, err
 	}
 
 	if rep := Reply(buf[1]); rep != 0x00 /* SUCCEEDED */ {
-		return nil, errors.New(rep.String())
+		return nil, rep
 	}
 
-	return readAddr(rw, buf)
+	return readAddr(r, buf)
 }
 
 func readAddr(r io.Reader, b []byte) (Addr, error) {
@@ -314,7 +431,7 @@ func DecodeUDPPacket(packet []byte) (addr Addr, payload []byte, err error) {
 		return
 	}
 
-	addr = splitAddr(packet[3:])
+	addr = SplitAddr(packet[3:])
 	if addr == nil {
 		err = errors.New("socks5 UDP addr is nil")
 	}
@@ -323,8 +440,8 @@ func DecodeUDPPacket(packet []byte) (addr Addr, payload []byte, err error) {
 	return
 }
 
-// splitAddr slices a SOCKS address from beginning of b. Returns nil if failed.
-func splitAddr(b []byte) Addr {
+// SplitAddr slices a SOCKS address from beginning of b. Returns nil if failed.
+func SplitAddr(b []byte) Addr {
 	addrLen := 1
 	if len(b) < addrLen {
 		return nil
@@ -0,0 +1,77 @@
+// Package uot provides client side UDP-over-TCP framing, compatible with
+// version 2 of the sing-box UDP over TCP protocol, and with DNS over TCP
+// as defined in RFC 1035 section 4.2.2.
+package uot
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"proxy-ns/proxy/transport/socks5"
+)
+
+// MagicAddress is the destination requested from the proxy server to
+// start a UDP over TCP stream.
+const MagicAddress = "sp.v2.udp-over-tcp.arpa"
+
+// Address types of the UDP over TCP request.
+const (
+	atypIPv4       = 0x00
+	atypIPv6       = 0x01
+	atypDomainName = 0x02
+)
+
+// Request returns the request header of a connected stream, whose
+// packets are all sent to target.
+func Request(target socks5.Addr) ([]byte, error) {
+	if !target.Valid() {
+		return nil, errors.New("invalid target address")
+	}
+	// isConnect
+	req := []byte{0x01}
+	switch target[0] {
+	case socks5.AtypIPv4:
+		req = append(req, atypIPv4)
+	case socks5.AtypIPv6:
+		req = append(req, atypIPv6)
+	case socks5.AtypDomainName:
+		req = append(req, atypDomainName)
+	default:
+		return nil, errors.New("unknown address type")
+	}
+	// Address and port are encoded the same way as SOCKS5.
+	return append(req, target[1:]...), nil
+}
+
+// WritePacket writes payload prefixed with its length to w.
+func WritePacket(w io.Writer, payload []byte) error {
+	if len(payload) > 0xffff {
+		return errors.New("packet too large")
+	}
+	buf := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(buf, uint16(len(payload)))
+	copy(buf[2:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadPacket reads a length prefixed packet from r into p. If p is too
+// small, the rest of the packet is discarded.
+func ReadPacket(r io.Reader, p []byte) (int, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n <= len(p) {
+		return io.ReadFull(r, p[:n])
+	}
+	if _, err := io.ReadFull(r, p); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(n-len(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-ns/config"
+	"proxy-ns/network"
+	"proxy-ns/proxy/transport/socks5"
+)
+
+// listenRelay returns a PacketConn sending packets to relayAddr through
+// forward, along with the address of the relay.
+func listenRelay(ctx context.Context, forward Dialer, relayAddr string) (net.PacketConn, net.Addr, error) {
+	// UDP packets to the relay are not wrapped with TLS.
+	if tlsDialer, ok := forward.(*TLSDialer); ok {
+		forward = tlsDialer.forward
+	}
+	if resolvingDialer, ok := forward.(*ResolvingDialer); ok {
+		forward = resolvingDialer.forward
+	}
+	if _, ok := forward.(*net.Dialer); ok {
+		addr, err := net.ResolveUDPAddr("udp", relayAddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolve udp address %s: %w", relayAddr, err)
+		}
+		pc, err := net.ListenPacket("udp", "0.0.0.0:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		return pc, addr, nil
+	}
+
+	associator, ok := forward.(UDPAssociator)
+	if !ok {
+		return nil, nil, errors.New("previous hop in proxy chain doesn't support UDP")
+	}
+	relay, err := associator.UDPAssociate(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("previous hop in proxy chain: %w", err)
+	}
+	conn, err := relay.Dial(relayAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("previous hop in proxy chain: %w", err)
+	}
+	addr := &stringAddr{network: "udp", address: relayAddr}
+	return &connPacketConn{Conn: conn, addr: addr}, addr, nil
+}
+
+// stringAddr is an address which may not be resolvable locally.
+type stringAddr struct {
+	network string
+	address string
+}
+
+func (a *stringAddr) Network() string { return a.network }
+func (a *stringAddr) String() string  { return a.address }
+
+// connPacketConn is a PacketConn sending to and receiving from the
+// remote address of Conn only.
+type connPacketConn struct {
+	net.Conn
+	addr   net.Addr
+	closed atomic.Bool
+}
+
+func (c *connPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, err := c.Conn.Read(p)
+		// UDP connections of the previous hop time out when idle.
+		if errors.Is(err, context.DeadlineExceeded) && !c.closed.Load() {
+			continue
+		}
+		return n, c.addr, err
+	}
+}
+
+func (c *connPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Conn.Write(p)
+}
+
+func (c *connPacketConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+// packetCodec encapsulates UDP packets sent to the relay.
+type packetCodec interface {
+	EncodePacket(target socks5.Addr, payload []byte) ([]byte, error)
+	// DecodePacket is mutable with `packet`.
+	DecodePacket(packet []byte) (target socks5.Addr, payload []byte, err error)
+}
+
+func newMuxedPacketConn(pc net.PacketConn, codec packetCodec) *muxedPacketConn {
+	return &muxedPacketConn{PacketConn: pc, codec: codec}
+}
+
+type muxedPacketConn struct {
+	net.PacketConn
+	codec   packetCodec
+	once    sync.Once
+	packets sync.Map // map[endpoint]chan []byte
+}
+
+type endpoint struct {
+	relayAddr  string
+	targetAddr string
+}
+
+func newSocketBuffer(timeout time.Duration) *socketBuffer {
+	s := &socketBuffer{
+		timeout: timeout,
+	}
+	s.notifyCh.Store(make(chan struct{}))
+	return s
+}
+
+type socketBuffer struct {
+	packets  [][]byte
+	mutex    sync.Mutex
+	notifyCh atomic.Value // chan struct{}
+	timeout  time.Duration
+}
+
+func (s *socketBuffer) Notify() {
+	old := s.notifyCh.Swap(make(chan struct{}))
+	close(old.(chan struct{}))
+}
+
+func (s *socketBuffer) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.mutex.Lock()
+	s.packets = append(s.packets, slices.Clone(p))
+	s.mutex.Unlock()
+
+	s.Notify()
+	return len(p), nil
+}
+
+func (s *socketBuffer) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		s.mutex.Lock()
+		if len(s.packets) == 0 {
+			s.mutex.Unlock()
+			select {
+			case <-s.notifyCh.Load().(chan struct{}):
+				continue
+			case <-time.After(s.timeout):
+				return 0, context.DeadlineExceeded
+			}
+		}
+		packet := s.packets[0]
+		if len(p) >= len(packet) {
+			s.packets = s.packets[1:]
+		} else {
+			s.packets[0] = s.packets[0][len(p):]
+		}
+		s.mutex.Unlock()
+		return copy(p, packet), nil
+	}
+}
+
+func (c *muxedPacketConn) poll() {
+	buf := make([]byte, network.MaxPacketSize)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		target, payload, err := c.codec.DecodePacket(buf[:n])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		ep := endpoint{
+			relayAddr:  addr.String(),
+			targetAddr: target.String(),
+		}
+		value, ok := c.packets.Load(ep)
+		if ok {
+			value.(*socketBuffer).Write(payload)
+		} else {
+			// gvisor's udp.NewForwarder cannot handle unrelated packet.
+			log.Println("Failed to associate packet from:", ep.targetAddr)
+		}
+	}
+}
+
+func (c *muxedPacketConn) ReadFrom(p []byte, relayAddr net.Addr, target socks5.Addr) (n int, err error) {
+	ep := endpoint{
+		relayAddr:  relayAddr.String(),
+		targetAddr: target.String(),
+	}
+	actual, _ := c.packets.LoadOrStore(ep, newSocketBuffer(config.UDPSessionTimeout))
+	go c.once.Do(c.poll)
+	return actual.(*socketBuffer).Read(p)
+}
+
+func (c *muxedPacketConn) WriteTo(p []byte, relayAddr net.Addr, target socks5.Addr) (n int, err error) {
+	data, err := c.codec.EncodePacket(target, p)
+	if err != nil {
+		return 0, err
+	}
+	n, err = c.PacketConn.WriteTo(data, relayAddr)
+	if err != nil {
+		return 0, err
+	}
+	if n < len(data) {
+		return 0, fmt.Errorf("short write: expected %d, not %d", len(data), n)
+	}
+	return len(p), nil
+}
+
+type udpConn struct {
+	*muxedPacketConn
+	relayClient interface{ Add(delta int64) }
+	relayAddr   net.Addr
+	targetAddr  socks5.Addr
+}
+
+func (c *udpConn) Read(p []byte) (n int, err error) {
+	return c.muxedPacketConn.ReadFrom(p, c.relayAddr, c.targetAddr)
+}
+
+func (c *udpConn) Write(p []byte) (n int, err error) {
+	return c.muxedPacketConn.WriteTo(p, c.relayAddr, c.targetAddr)
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.targetAddr.UDPAddr()
+}
+
+func (c *udpConn) Close() error {
+	c.relayClient.Add(-1)
+	return nil
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"proxy-ns/proxy/transport/socks5"
+	"proxy-ns/proxy/transport/uot"
+)
+
+// UDPOverTCPClient relays UDP packets through TCP connections of
+// forward, for upstreams which don't support UDP. Packets to port 53 are
+// sent as DNS over TCP, others are encapsulated with UDP over TCP if
+// enabled, or dropped.
+type UDPOverTCPClient struct {
+	forward     Dialer
+	encapsulate bool
+}
+
+// UDPOverTCP returns a UDPOverTCPClient connecting through forward.
+// If encapsulate is true, packets other than DNS are sent with UDP over
+// TCP, which must be supported by the proxy server.
+func UDPOverTCP(forward Dialer, encapsulate bool) *UDPOverTCPClient {
+	return &UDPOverTCPClient{
+		forward:     forward,
+		encapsulate: encapsulate,
+	}
+}
+
+func (d *UDPOverTCPClient) UDPAssociate(ctx context.Context) (UDPRelay, error) {
+	return &uotRelay{client: d}, nil
+}
+
+// addrConnector is implemented by Dialers which request targets as SOCKS5
+// addresses.
+type addrConnector interface {
+	connectAddr(ctx context.Context, addr socks5.Addr) (net.Conn, error)
+}
+
+// uotRelay connects a TCP connection for each target.
+type uotRelay struct {
+	client    *UDPOverTCPClient
+	count     atomic.Int64
+	finalizer func()
+}
+
+func (r *uotRelay) Dial(address string) (net.Conn, error) {
+	conn, err := r.dial(address)
+	if err != nil {
+		// Finalize the relay if it's never used.
+		r.Add(0)
+		return nil, fmt.Errorf("udp over tcp %s: %w", address, err)
+	}
+	r.Add(1)
+	return &uotConn{
+		Conn:  conn,
+		r:     bufio.NewReader(conn),
+		relay: r,
+		addr:  &stringAddr{network: "udp", address: address},
+	}, nil
+}
+
+// dial connects for address. UDPRelay.Dial takes no context, the
+// connection is bounded by the connect and handshake timeouts of
+// forward.
+func (r *uotRelay) dial(address string) (net.Conn, error) {
+	ctx := context.Background()
+	target, err := serializeAddr(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize address: %w", err)
+	}
+	_, port, _ := splitHostPort(address)
+	if port == 53 {
+		conn, err := r.client.forward.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("udp %s via DNS over TCP\n", address)
+		return conn, nil
+	}
+	if !r.client.encapsulate {
+		return nil, errors.New("upstream doesn't support UDP")
+	}
+
+	req, err := uot.Request(target)
+	if err != nil {
+		return nil, err
+	}
+	// The magic address has port 0, which isn't a valid target of
+	// DialContext, so it's requested as is.
+	connector, ok := r.client.forward.(addrConnector)
+	if !ok {
+		return nil, errors.New("upstream doesn't support UDP over TCP")
+	}
+	conn, err := connector.connectAddr(ctx, socks5.SerializeAddr(uot.MagicAddress, nil, 0))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Printf("udp %s via UDP over TCP\n", address)
+	return conn, nil
+}
+
+func (r *uotRelay) Add(delta int64) {
+	if r.count.Add(delta) == 0 && r.finalizer != nil {
+		r.finalizer()
+	}
+}
+
+func (r *uotRelay) SetFinalizer(f func()) {
+	r.finalizer = f
+}
+
+// uotConn sends length prefixed packets over TCP.
+type uotConn struct {
+	net.Conn
+	r     *bufio.Reader
+	relay *uotRelay
+	addr  net.Addr
+	once  sync.Once
+}
+
+func (c *uotConn) Read(p []byte) (int, error) {
+	return uot.ReadPacket(c.r, p)
+}
+
+func (c *uotConn) Write(p []byte) (int, error) {
+	if err := uot.WritePacket(c.Conn, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *uotConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *uotConn) Close() error {
+	c.once.Do(func() {
+		c.relay.Add(-1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,45 @@
+package route
+
+import (
+	"net"
+
+	"proxy-ns/config"
+)
+
+// Remapper rewrites destinations of connections before they are routed.
+type Remapper struct {
+	remaps []config.Remap
+}
+
+func NewRemapper(remaps []config.Remap) *Remapper {
+	return &Remapper{remaps: remaps}
+}
+
+// Remap returns m with the destination rewritten by the first matching
+// remap, or nil if none matches. Domain names are matched by the name
+// resolved by fake DNS, so they match the same host as its addresses.
+func (r *Remapper) Remap(m *Metadata) *Metadata {
+	host := normalizeDomain(m.Domain)
+	if host == "" {
+		host = m.IP.String()
+	}
+	for _, remap := range r.remaps {
+		if remap.FromHost != host || (remap.FromPort != 0 && remap.FromPort != m.Port) {
+			continue
+		}
+		rewritten := &Metadata{
+			Network: m.Network,
+			Port:    m.Port,
+		}
+		if remap.ToPort != 0 {
+			rewritten.Port = remap.ToPort
+		}
+		if ip := net.ParseIP(remap.ToHost); ip != nil {
+			rewritten.IP = ip
+		} else {
+			rewritten.Domain = remap.ToHost
+		}
+		return rewritten
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package route
+
+import (
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-ns/config"
+)
+
+// Metadata describes a connection being routed.
+type Metadata struct {
+	// Network is "tcp" or "udp".
+	Network string
+	// Domain is the domain name of the destination, resolved by fake
+	// DNS or set by a remap, if any.
+	Domain string
+	// IP is the destination address, it's nil if Domain is set.
+	IP   net.IP
+	Port uint16
+}
+
+// Address returns the destination address, with the domain name if known.
+func (m *Metadata) Address() string {
+	host := m.Domain
+	if host == "" {
+		host = m.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(m.Port)))
+}
+
+type Rule struct {
+	config.Rule
+	// Index is the position of the rule in the configuration.
+	Index int
+
+	regexps  []*regexp.Regexp
+	ruleSets []*RuleSet
+}
+
+// Router matches connections against ordered rules.
+type Router struct {
+	rules    []*Rule
+	ruleSets []*RuleSet
+}
+
+// New returns a Router with rules referring to ruleSets, which are
+// validated by config. Files of rule sets are loaded.
+func New(rules []config.Rule, ruleSets []config.RuleSet) (*Router, error) {
+	r := &Router{}
+	loaded := make(map[string]*RuleSet, len(ruleSets))
+	for _, cfg := range ruleSets {
+		s, err := LoadRuleSet(cfg)
+		if err != nil {
+			return nil, err
+		}
+		loaded[cfg.Name] = s
+		r.ruleSets = append(r.ruleSets, s)
+	}
+	for i, rule := range rules {
+		compiled := &Rule{Rule: rule, Index: i}
+		for _, expr := range rule.DomainRegex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			compiled.regexps = append(compiled.regexps, re)
+		}
+		for _, name := range rule.RuleSet {
+			compiled.ruleSets = append(compiled.ruleSets, loaded[name])
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// Start reloads changed rule sets every interval in background.
+func (r *Router) Start(interval time.Duration) {
+	for _, s := range r.ruleSets {
+		go s.watch(interval)
+	}
+}
+
+// Match returns the first rule matching m, or nil if none matches.
+func (r *Router) Match(m *Metadata) *Rule {
+	domain := normalizeDomain(m.Domain)
+	for _, rule := range r.rules {
+		if rule.match(m, domain) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(m *Metadata, domain string) bool {
+	if r.Network != "" && r.Network != m.Network {
+		return false
+	}
+	if len(r.Port) != 0 && !slices.ContainsFunc(r.Port, func(p config.PortRange) bool {
+		return p.Contains(m.Port)
+	}) {
+		return false
+	}
+	if len(r.Domain) == 0 && len(r.DomainSuffix) == 0 && len(r.DomainKeyword) == 0 &&
+		len(r.regexps) == 0 && len(r.CIDR) == 0 && len(r.ruleSets) == 0 {
+		return true
+	}
+	if domain != "" && r.matchDomain(domain) {
+		return true
+	}
+	for _, s := range r.ruleSets {
+		if s.match(m, domain) {
+			return true
+		}
+	}
+	return m.IP != nil && slices.ContainsFunc(r.CIDR, func(n *net.IPNet) bool {
+		return n.Contains(m.IP)
+	})
+}
+
+func (r *Rule) matchDomain(domain string) bool {
+	if slices.Contains(r.Domain, domain) {
+		return true
+	}
+	for _, suffix := range r.DomainSuffix {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	for _, keyword := range r.DomainKeyword {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	return slices.ContainsFunc(r.regexps, func(re *regexp.Regexp) bool {
+		return re.MatchString(domain)
+	})
+}
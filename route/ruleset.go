@@ -0,0 +1,158 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"proxy-ns/config"
+)
+
+// RuleSet matches destinations against a list loaded from a file, which
+// is reloaded when it changes.
+type RuleSet struct {
+	config.RuleSet
+
+	matcher atomic.Pointer[ruleSetMatcher]
+	modTime time.Time
+	size    int64
+}
+
+type ruleSetMatcher struct {
+	cidrs cidrSet
+	// exact and suffixes are sets of domain names, suffixes also
+	// match subdomains.
+	exact    map[string]struct{}
+	suffixes map[string]struct{}
+}
+
+// LoadRuleSet loads the file of cfg.
+func LoadRuleSet(cfg config.RuleSet) (*RuleSet, error) {
+	s := &RuleSet{RuleSet: cfg}
+	if _, _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload loads the file if it changed since the last load, and reports
+// the number of loaded entries and whether it changed. Failures keep the
+// last loaded entries.
+func (s *RuleSet) reload() (int, bool, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return 0, false, fmt.Errorf("rule set %s: %w", s.Name, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, fmt.Errorf("rule set %s: %w", s.Name, err)
+	}
+	if s.matcher.Load() != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return 0, false, nil
+	}
+
+	m := &ruleSetMatcher{
+		exact:    make(map[string]struct{}),
+		suffixes: make(map[string]struct{}),
+	}
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch s.Type {
+		case "cidr":
+			ipNet, err := parseCIDR(fields[0])
+			if err != nil {
+				return 0, false, fmt.Errorf("rule set %s: line %d: %w", s.Name, lineno, err)
+			}
+			m.cidrs.insert(ipNet)
+			n++
+		case "domain":
+			// A leading dot or wildcard is implied, as subdomains
+			// are matched.
+			domain := strings.TrimPrefix(strings.TrimPrefix(fields[0], "*"), ".")
+			m.suffixes[normalizeDomain(domain)] = struct{}{}
+			n++
+		case "hosts":
+			// The address is ignored, hosts files are commonly
+			// used as block lists.
+			for _, domain := range fields[1:] {
+				m.exact[normalizeDomain(domain)] = struct{}{}
+				n++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, false, fmt.Errorf("rule set %s: %w", s.Name, err)
+	}
+	s.matcher.Store(m)
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return n, true, nil
+}
+
+// parseCIDR parses a network, or a single address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+func (s *RuleSet) match(m *Metadata, domain string) bool {
+	matcher := s.matcher.Load()
+	if m.IP != nil && matcher.cidrs.contains(m.IP) {
+		return true
+	}
+	if domain == "" {
+		return false
+	}
+	if _, ok := matcher.exact[domain]; ok {
+		return true
+	}
+	// Try the domain and its parent domains.
+	for suffix := domain; ; {
+		if _, ok := matcher.suffixes[suffix]; ok {
+			return true
+		}
+		_, parent, ok := strings.Cut(suffix, ".")
+		if !ok {
+			return false
+		}
+		suffix = parent
+	}
+}
+
+// watch reloads the rule set every interval if it changed.
+func (s *RuleSet) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, changed, err := s.reload()
+		if err != nil {
+			log.Printf("Failed to reload %s, keep using loaded entries\n", err)
+		} else if changed {
+			log.Printf("rule set %s reloaded: %d entries\n", s.Name, n)
+		}
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
@@ -0,0 +1,70 @@
+package route
+
+import "net"
+
+// ipTrie is a binary prefix trie of networks of the same address family.
+type ipTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	// end reports whether a network ends at this node, so that all
+	// addresses below it are contained.
+	end bool
+}
+
+// insert adds the network of the first ones bits of ip.
+func (t *ipTrie) insert(ip []byte, ones int) {
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		if node.end {
+			return
+		}
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.end = true
+	// Networks below are contained.
+	node.children = [2]*trieNode{}
+}
+
+// contains reports whether ip is in any of the networks.
+func (t *ipTrie) contains(ip []byte) bool {
+	node := &t.root
+	for i := 0; i < len(ip)*8; i++ {
+		if node.end {
+			return true
+		}
+		node = node.children[ip[i/8]>>(7-i%8)&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.end
+}
+
+// cidrSet matches addresses of both families.
+type cidrSet struct {
+	v4 ipTrie
+	v6 ipTrie
+}
+
+func (s *cidrSet) insert(ipNet *net.IPNet) {
+	ones, bits := ipNet.Mask.Size()
+	if bits == 32 {
+		s.v4.insert(ipNet.IP.To4(), ones)
+	} else {
+		s.v6.insert(ipNet.IP.To16(), ones)
+	}
+}
+
+func (s *cidrSet) contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return s.v4.contains(ip4)
+	}
+	return s.v6.contains(ip.To16())
+}
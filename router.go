@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"net"
+	"slices"
+	"strings"
+
+	"proxy-ns/config"
+	"proxy-ns/proxy"
+	"proxy-ns/route"
+)
+
+// upstream is where connections are routed to.
+type upstream struct {
+	name   string
+	dialer proxy.Dialer
+	// associator is nil if the upstream doesn't support UDP.
+	associator  proxy.UDPAssociator
+	udpFallback proxy.UDPAssociator
+	// direct reports whether connections are made by the daemon
+	// itself, domain names are resolved locally then.
+	direct bool
+}
+
+func newUpstream(name string, dialer proxy.Dialer, udpOverTCP string) *upstream {
+	u := &upstream{
+		name:   name,
+		dialer: dialer,
+	}
+	u.associator, _ = dialer.(proxy.UDPAssociator)
+	if udpOverTCP != "off" {
+		u.udpFallback = proxy.UDPOverTCP(dialer, udpOverTCP == "uot")
+	}
+	return u
+}
+
+// router selects the upstream of each connection by rules, after its
+// destination is remapped. Connections to the host gateway go to the
+// host loopback directly.
+type router struct {
+	remapper  *route.Remapper
+	rules     *route.Router
+	proxy     *upstream
+	upstreams map[string]*upstream
+	direct    *upstream
+
+	hostGateway      string
+	hostGatewayIP    net.IP
+	hostGatewayPorts []config.PortRange
+}
+
+// newRouter returns a router sending connections to dialer by default,
+// and to dialers of named proxy servers when rules name them.
+func newRouter(cfg *config.Config, dialer proxy.Dialer, named map[string]proxy.Dialer) (*router, error) {
+	rules, err := route.New(cfg.Rules, cfg.RuleSets)
+	if err != nil {
+		return nil, err
+	}
+	rules.Start(cfg.RuleSetInterval)
+	r := &router{
+		remapper:  route.NewRemapper(cfg.Remaps),
+		rules:     rules,
+		proxy:     newUpstream("", dialer, cfg.UDPOverTCP),
+		upstreams: make(map[string]*upstream, len(named)),
+		direct: &upstream{
+			name:       "direct",
+			dialer:     &net.Dialer{Timeout: cfg.ConnectTimeout},
+			associator: proxy.DirectUDP,
+			direct:     true,
+		},
+		hostGateway:      cfg.HostGateway,
+		hostGatewayIP:    cfg.HostGatewayIP,
+		hostGatewayPorts: cfg.HostGatewayPorts,
+	}
+	for name, d := range named {
+		r.upstreams[name] = newUpstream(name, d, cfg.UDPOverTCP)
+	}
+	return r, nil
+}
+
+// route returns the upstream of the connection described by m, or nil
+// if it's rejected, along with the remapped destination.
+func (r *router) route(m *route.Metadata) (*upstream, *route.Metadata) {
+	if loopback := r.toHostGateway(m); loopback != nil {
+		if len(r.hostGatewayPorts) != 0 && !slices.ContainsFunc(r.hostGatewayPorts, func(p config.PortRange) bool {
+			return p.Contains(m.Port)
+		}) {
+			log.Printf("%s %s: port not allowed on host gateway\n", m.Network, m.Address())
+			return nil, m
+		}
+		log.Printf("%s %s: host gateway to %s\n", m.Network, m.Address(), loopback.Address())
+		return r.direct, loopback
+	}
+	if rewritten := r.remapper.Remap(m); rewritten != nil {
+		log.Printf("%s %s: remapped to %s\n", m.Network, m.Address(), rewritten.Address())
+		m = rewritten
+	}
+	return r.match(m), m
+}
+
+// toHostGateway returns m with the destination rewritten to the host
+// loopback address, or nil if it's not to the host gateway.
+func (r *router) toHostGateway(m *route.Metadata) *route.Metadata {
+	loopback := &route.Metadata{
+		Network: m.Network,
+		Port:    m.Port,
+	}
+	switch {
+	case r.hostGateway != "" && strings.EqualFold(strings.TrimSuffix(m.Domain, "."), r.hostGateway):
+		loopback.IP = net.IPv4(127, 0, 0, 1)
+	case r.hostGatewayIP != nil && r.hostGatewayIP.Equal(m.IP):
+		if r.hostGatewayIP.To4() != nil {
+			loopback.IP = net.IPv4(127, 0, 0, 1)
+		} else {
+			loopback.IP = net.IPv6loopback
+		}
+	default:
+		return nil
+	}
+	return loopback
+}
+
+func (r *router) match(m *route.Metadata) *upstream {
+	rule := r.rules.Match(m)
+	if rule == nil {
+		return r.proxy
+	}
+	switch rule.Action {
+	case "direct":
+		log.Printf("%s %s: direct by rule %d\n", m.Network, m.Address(), rule.Index)
+		return r.direct
+	case "reject":
+		log.Printf("%s %s: rejected by rule %d\n", m.Network, m.Address(), rule.Index)
+		return nil
+	default:
+		if rule.Upstream != "" {
+			log.Printf("%s %s: upstream %s by rule %d\n", m.Network, m.Address(), rule.Upstream, rule.Index)
+			return r.upstreams[rule.Upstream]
+		}
+		return r.proxy
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 
@@ -14,6 +14,7 @@ import (
 	"proxy-ns/fakedns"
 	"proxy-ns/network"
 	"proxy-ns/proxy"
+	"proxy-ns/route"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -27,7 +28,65 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
-func manageTun(mtu uint32, fd int, socks5Client *proxy.SOCKS5Client, fakeDNSServer *fakedns.Server) (err error) {
+// synRTO is the initial retransmission timeout of SYNs on Linux, which
+// doubles on each retransmission.
+const synRTO = time.Second
+
+// pendingDial is the dial of a held SYN. It's cancelled when the guest
+// gives up: when it resets the connection, or stops retransmitting the
+// SYN, as Linux doesn't send RST when a connecting socket is closed or
+// times out.
+type pendingDial struct {
+	cancel context.CancelFunc
+
+	mutex    sync.Mutex
+	lastSYN  time.Time
+	interval time.Duration
+}
+
+func newPendingDial(cancel context.CancelFunc) *pendingDial {
+	return &pendingDial{
+		cancel:   cancel,
+		lastSYN:  time.Now(),
+		interval: synRTO,
+	}
+}
+
+// syn records a retransmitted SYN.
+func (d *pendingDial) syn() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	d.interval = now.Sub(d.lastSYN)
+	d.lastSYN = now
+}
+
+// stale reports whether the next SYN is overdue, allowing for a
+// retransmission timeout twice as long as the last one.
+func (d *pendingDial) stale() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return time.Since(d.lastSYN) > 2*d.interval+synRTO
+}
+
+// watch cancels the dial once the SYN is stale, until ctx is done.
+func (d *pendingDial) watch(ctx context.Context) {
+	ticker := time.NewTicker(synRTO)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if d.stale() {
+				d.cancel()
+				return
+			}
+		}
+	}
+}
+
+func manageTun(mtu uint32, fd int, router *router, retry proxy.Retry, tcpResolver, udpResolver proxy.Resolver, fakeDNSServer *fakedns.Server) (*stack.Stack, error) {
 	s := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
@@ -38,22 +97,22 @@ func manageTun(mtu uint32, fd int, socks5Client *proxy.SOCKS5Client, fakeDNSServ
 		MTU: mtu,
 	})
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	nicID := s.NextNICID()
 	if err := s.CreateNIC(nicID, linkEP); err != nil {
-		return errors.New(err.String())
+		return nil, errors.New(err.String())
 	}
 
 	e := s.SetPromiscuousMode(nicID, true)
 	if e != nil {
-		return errors.New(e.String())
+		return nil, errors.New(e.String())
 	}
 
 	e = s.SetSpoofing(nicID, true)
 	if e != nil {
-		return errors.New(e.String())
+		return nil, errors.New(e.String())
 	}
 
 	s.SetRouteTable([]tcpip.Route{
@@ -67,40 +126,80 @@ func manageTun(mtu uint32, fd int, socks5Client *proxy.SOCKS5Client, fakeDNSServ
 		},
 	})
 
-	var addrFromID func(stack.TransportEndpointID) string
-	if fakeDNSServer != nil {
-		addrFromID = func(id stack.TransportEndpointID) (result string) {
-			remoteAddr := id.LocalAddress
-			remotePort := id.LocalPort
-			if fakeDNSServer.Contains(remoteAddr.AsSlice()) {
-				name := fakeDNSServer.NameFromIP(remoteAddr.AsSlice())
-				if name == "" {
-					return ""
-				}
-				result = net.JoinHostPort(name, strconv.Itoa(int(remotePort)))
-			} else {
-				result = net.JoinHostPort(remoteAddr.String(), strconv.Itoa(int(remotePort)))
-			}
-			return result
+	// metadataFromID returns the metadata of a new flow. The mapping of
+	// a fake IP is kept until release is called when the flow ends.
+	metadataFromID := func(network string, id stack.TransportEndpointID) (m *route.Metadata, release func(), ok bool) {
+		m = &route.Metadata{
+			Network: network,
+			Port:    id.LocalPort,
 		}
-	} else {
-		addrFromID = func(id stack.TransportEndpointID) (result string) {
-			remoteAddr := id.LocalAddress
-			remotePort := id.LocalPort
-			return net.JoinHostPort(remoteAddr.String(), strconv.Itoa(int(remotePort)))
+		release = func() {}
+		ip := net.IP(id.LocalAddress.AsSlice())
+		if fakeDNSServer != nil && fakeDNSServer.Contains(ip) {
+			m.Domain = fakeDNSServer.Acquire(ip)
+			if m.Domain == "" {
+				return nil, nil, false
+			}
+			release = func() {
+				fakeDNSServer.Release(ip)
+			}
+		} else {
+			m.IP = ip
 		}
+		return m, release, true
 	}
 
+	// pendingDials maps IDs of held SYNs to their dials, so that the
+	// guest giving up cancels the dial.
+	var pendingDials sync.Map
 	tcpForwarder := tcp.NewForwarder(s, 0, 2<<10, func(r *tcp.ForwarderRequest) {
-		remoteAddrStr := addrFromID(r.ID())
-		if remoteAddrStr == "" {
+		id := r.ID()
+		ctx, cancel := context.WithCancel(context.Background())
+		dial := newPendingDial(cancel)
+		pendingDials.Store(id, dial)
+		defer func() {
+			pendingDials.Delete(id)
+			cancel()
+		}()
+		go dial.watch(ctx)
+
+		m, release, ok := metadataFromID("tcp", id)
+		if !ok {
 			r.Complete(true)
 			return
 		}
+		forwarding := false
+		defer func() {
+			if !forwarding {
+				release()
+			}
+		}()
+		u, m := router.route(m)
+		if u == nil {
+			r.Complete(true)
+			return
+		}
+		remoteAddrStr := m.Address()
 
-		remoteConn, err := socks5Client.Connect(remoteAddrStr)
+		if tcpResolver != nil && !u.direct {
+			var err error
+			remoteAddrStr, err = proxy.ResolveAddress(ctx, tcpResolver, remoteAddrStr)
+			if err != nil {
+				log.Println(err)
+				r.Complete(true)
+				return
+			}
+		}
+
+		// The SYN is held while retrying, so the guest doesn't see
+		// transient failures.
+		remoteConn, err := retry.Dial(ctx, u.dialer, "tcp", remoteAddrStr)
 		if err != nil {
-			log.Println(err)
+			if ctx.Err() != nil {
+				log.Printf("tcp %s: cancelled by guest\n", remoteAddrStr)
+			} else {
+				log.Println(err)
+			}
 			r.Complete(true)
 			return
 		}
@@ -116,20 +215,58 @@ func manageTun(mtu uint32, fd int, socks5Client *proxy.SOCKS5Client, fakeDNSServ
 		originConn := gonet.NewTCPConn(&wq, ep)
 
 		r.Complete(false)
-		go forwardConn(originConn, remoteConn, io.Copy)
+		forwarding = true
+		go func() {
+			forwardConn(originConn, remoteConn, io.Copy)
+			release()
+		}()
 	})
+	handleTCP := func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		h := header.TCP(pkt.TransportHeader().Slice())
+		if len(h) >= header.TCPMinimumSize {
+			if dial, ok := pendingDials.Load(id); ok {
+				switch flags := h.Flags(); {
+				case flags.Contains(header.TCPFlagRst):
+					dial.(*pendingDial).cancel()
+				case flags.Contains(header.TCPFlagSyn) && !flags.Contains(header.TCPFlagAck):
+					dial.(*pendingDial).syn()
+				}
+			}
+		}
+		return tcpForwarder.HandlePacket(id, pkt)
+	}
+	// endpoint is a guest endpoint, which has a relay for each
+	// upstream it sends packets to.
 	type endpoint struct {
-		address tcpip.Address
-		port    uint16
+		address  tcpip.Address
+		port     uint16
+		upstream *upstream
 	}
 	var relays sync.Map
-	relayFromID := func(id stack.TransportEndpointID) *proxy.SOCKS5UDPRelayClient {
+	relayFromID := func(ctx context.Context, u *upstream, id stack.TransportEndpointID) proxy.UDPRelay {
+		if u.associator == nil && u.udpFallback == nil {
+			log.Println("udp-associate: upstream doesn't support UDP")
+			return nil
+		}
 		ep := endpoint{
-			address: id.RemoteAddress,
-			port:    id.RemotePort,
+			address:  id.RemoteAddress,
+			port:     id.RemotePort,
+			upstream: u,
 		}
-		onceValue := sync.OnceValue(func() *proxy.SOCKS5UDPRelayClient {
-			relay, err := socks5Client.UDPAssociate()
+		onceValue := sync.OnceValue(func() proxy.UDPRelay {
+			var (
+				relay proxy.UDPRelay
+				err   error
+			)
+			if u.associator != nil {
+				relay, err = u.associator.UDPAssociate(ctx)
+			} else {
+				err = errors.New("udp-associate: upstream doesn't support UDP")
+			}
+			if err != nil && u.udpFallback != nil {
+				log.Printf("%s, falling back to TCP\n", err)
+				relay, err = u.udpFallback.UDPAssociate(ctx)
+			}
 			if err != nil {
 				log.Println(err)
 				return nil
@@ -140,7 +277,7 @@ func manageTun(mtu uint32, fd int, socks5Client *proxy.SOCKS5Client, fakeDNSServ
 			return relay
 		})
 		actual, _ := relays.LoadOrStore(ep, onceValue)
-		relay := actual.(func() *proxy.SOCKS5UDPRelayClient)()
+		relay := actual.(func() proxy.UDPRelay)()
 		if relay == nil {
 			relays.Delete(ep)
 			return nil
@@ -157,11 +294,32 @@ func manageTun(mtu uint32, fd int, socks5Client *proxy.SOCKS5Client, fakeDNSServ
 		originConn := gonet.NewUDPConn(&wq, ep)
 
 		id := r.ID()
-		remoteAddrStr := addrFromID(id)
-		if remoteAddrStr == "" {
+		m, release, ok := metadataFromID("udp", id)
+		if !ok {
 			return false
 		}
-		relay := relayFromID(id)
+		forwarding := false
+		defer func() {
+			if !forwarding {
+				release()
+			}
+		}()
+		u, m := router.route(m)
+		if u == nil {
+			originConn.Close()
+			return false
+		}
+		remoteAddrStr := m.Address()
+		ctx := context.Background()
+		if udpResolver != nil && !u.direct {
+			var err error
+			remoteAddrStr, err = proxy.ResolveAddress(ctx, udpResolver, remoteAddrStr)
+			if err != nil {
+				log.Println(err)
+				return false
+			}
+		}
+		relay := relayFromID(ctx, u, id)
 		if relay == nil {
 			return false
 		}
@@ -170,12 +328,16 @@ func manageTun(mtu uint32, fd int, socks5Client *proxy.SOCKS5Client, fakeDNSServ
 			log.Println(err)
 			return false
 		}
-		go forwardConn(originConn, remoteConn, copyPacketData)
+		forwarding = true
+		go func() {
+			forwardConn(originConn, remoteConn, copyPacketData)
+			release()
+		}()
 		return true
 	})
-	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, handleTCP)
 	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
-	return nil
+	return s, nil
 }
 
 type copyFunc func(io.Writer, io.Reader) (int64, error)
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"proxy-ns/config"
+	"proxy-ns/proxy"
+)
+
+// newDialer returns the Dialer connecting through the configured proxy
+// servers, along with Dialers of each proxy server by name.
+func newDialer(cfg *config.Config) (proxy.Dialer, map[string]proxy.Dialer, error) {
+	direct := &net.Dialer{Timeout: cfg.ConnectTimeout}
+	if cfg.TCPFastOpen {
+		direct.Control = proxy.FastOpenControl
+	}
+	resolving := proxy.Resolving(direct, cfg.ResolveInterval)
+	resolving.Start()
+	var forward proxy.Dialer = resolving
+	for i, hop := range cfg.ProxyChain {
+		d, err := newProxyDialer(hop, forward)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid proxy_chain[%d]: %w", i, err)
+		}
+		forward = d
+	}
+	primary, err := newProxyDialer(cfg.Proxy, forward)
+	if err != nil {
+		return nil, nil, err
+	}
+	named := map[string]proxy.Dialer{
+		cfg.Proxy.DisplayName(): primary,
+	}
+	if len(cfg.Proxies) == 0 {
+		return primary, named, nil
+	}
+
+	group := proxy.NewGroup(proxy.Policy(cfg.LoadBalance), proxy.HealthCheck{
+		Interval: cfg.HealthCheckInterval,
+		Timeout:  cfg.HealthCheckTimeout,
+		Target:   cfg.HealthCheckTarget,
+	})
+	group.Add(cfg.Proxy.DisplayName(), primary)
+	for i, p := range cfg.Proxies {
+		d, err := newProxyDialer(p, forward)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid proxies[%d]: %w", i, err)
+		}
+		group.Add(p.DisplayName(), d)
+		named[p.DisplayName()] = d
+	}
+	group.Start()
+	return group, named, nil
+}
+
+// newProxyDialer returns the Dialer of p, which connects to the proxy
+// server through forward.
+func newProxyDialer(p config.Proxy, forward proxy.Dialer) (proxy.Dialer, error) {
+	if p.TLS {
+		tlsConfig, err := newTLSConfig(p)
+		if err != nil {
+			return nil, err
+		}
+		forward = proxy.TLS(forward, tlsConfig)
+	}
+	network, address := p.NetworkAddress()
+	switch p.ProxyType {
+	case "socks5":
+		d := proxy.SOCKS5(network, address, p.Username, p.Password, forward)
+		d.SetPool(proxy.Pool{
+			Size:          p.PoolSize,
+			IdleTimeout:   p.PoolIdleTimeout,
+			CheckInterval: p.PoolCheckInterval,
+		})
+		d.SetPipeline(p.Pipeline, p.EarlyData)
+		return d, nil
+	case "socks4":
+		return proxy.SOCKS4(network, address, p.Username, forward), nil
+	case "socks4a":
+		return proxy.SOCKS4A(network, address, p.Username, forward), nil
+	case "http":
+		return proxy.HTTP(network, address, p.Username, p.Password, forward), nil
+	case "shadowsocks":
+		d, err := proxy.Shadowsocks(network, address, p.Cipher, p.Password, forward)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("Unsupported proxy type: %s", p.ProxyType)
+	}
+}
+
+func newTLSConfig(p config.Proxy) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: p.TLSServerName,
+	}
+	if p.TLSCA != "" {
+		b, err := os.ReadFile(p.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read tls ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificate found in %s", p.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if p.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(p.TLSCert, p.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load tls certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if pins := p.TLSPinSHA256; len(pins) != 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(sum[:], pin) {
+						return nil
+					}
+				}
+			}
+			return errors.New("no certificate matches pinned public keys")
+		}
+	}
+	return tlsConfig, nil
+}